@@ -0,0 +1,87 @@
+package cmds
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"strconv"
+	"strings"
+)
+
+// parseSignedNumberFlags parses the flags of a command with DisableFlagParsing set, which takes
+// negative numbers as arguments, like the -1.5 in "volume -1.5". The remaining arguments are returned
+// by cmd.Flags().Args() afterwards. Since the command's flags weren't parsed before the
+// PersistentPreRunE hooks, this is run in place of them and sets up logging and the conf file itself
+func parseSignedNumberFlags(cmd *cobra.Command, args []string) error {
+	// ParseFlags does nothing while DisableFlagParsing is set, but it also merges the persistent
+	// flags of parent commands, so parsing is enabled just for the call
+	cmd.DisableFlagParsing = false
+	err := cmd.ParseFlags(signedNumberArgs(cmd, args))
+	cmd.DisableFlagParsing = true
+	if err != nil {
+		return err
+	}
+	if help, _ := cmd.Flags().GetBool("help"); help {
+		return pflag.ErrHelp
+	}
+	setupLogger()
+	return loadConfig(cmd, cmd.Flags().Args())
+}
+
+// signedNumberArgs moves negative numbers which aren't flag values after a "--" so that they're
+// parsed as arguments of cmd instead of shorthand flags. Any arguments following the first of them
+// are moved too so that the order of arguments is kept
+func signedNumberArgs(cmd *cobra.Command, args []string) []string {
+	for _, arg := range args {
+		if arg == "--" {
+			return args
+		}
+	}
+
+	flags := make([]string, 0, len(args))
+	positional := make([]string, 0)
+	moving := false
+	for i, arg := range args {
+		switch {
+		case i > 0 && takesValue(cmd, args[i-1]):
+			flags = append(flags, arg)
+		case strings.HasPrefix(arg, "-") && !isNumber(arg):
+			flags = append(flags, arg)
+		case moving || strings.HasPrefix(arg, "-"):
+			moving = true
+			positional = append(positional, arg)
+		default:
+			flags = append(flags, arg)
+		}
+	}
+	if len(positional) == 0 {
+		return args
+	}
+	return append(append(flags, "--"), positional...)
+}
+
+// takesValue reports whether arg is a flag of cmd which is followed by a separate value
+func takesValue(cmd *cobra.Command, arg string) bool {
+	if !strings.HasPrefix(arg, "-") || strings.Contains(arg, "=") || isNumber(arg) {
+		return false
+	}
+	name := strings.TrimLeft(arg, "-")
+	if strings.HasPrefix(arg, "--") {
+		f := cmd.Flags().Lookup(name)
+		if f == nil {
+			f = cmd.InheritedFlags().Lookup(name)
+		}
+		return f != nil && f.NoOptDefVal == ""
+	}
+	// grouped shorthand flags only take a value if the last one does
+	name = name[len(name)-1:]
+	f := cmd.Flags().ShorthandLookup(name)
+	if f == nil {
+		f = cmd.InheritedFlags().ShorthandLookup(name)
+	}
+	return f != nil && f.NoOptDefVal == ""
+}
+
+func isNumber(arg string) bool {
+	_, err := strconv.ParseFloat(arg, 64)
+	return err == nil
+}
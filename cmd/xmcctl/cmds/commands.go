@@ -1,36 +1,60 @@
 package cmds
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"git.poundadm.net/anachronism/xmcctl/pkg/apis/config"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
 	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
 var (
 	RootCommand *cobra.Command
 
-	ConfigPath        string
-	DiscoverBindAddr  string
-	DiscoverBroadcast bool
-	DiscoverRefresh   bool
-	DiscoverTimeout   time.Duration
-	DiscoverWrite     bool
-	LogDebug          bool
-	LogJson           bool
+	ConfigPath          string
+	ControlTimeout      time.Duration
+	ControlZone         string
+	DeviceListArchived  bool
+	DeviceListTimeout   time.Duration
+	DeviceName          string
+	DiscoverBindAddr    string
+	DiscoverBroadcast   bool
+	DiscoverConcurrency int
+	DiscoverInterface   string
+	DiscoverInterval    time.Duration
+	DiscoverOutput      string
+	DiscoverProtocol    string
+	DiscoverRate        int
+	DiscoverRefresh     bool
+	DiscoverTimeout     time.Duration
+	DiscoverWatch       bool
+	DiscoverWrite       bool
+	GetTimeout          time.Duration
+	LogDebug            bool
+	LogJson             bool
+	SendNoAck           bool
+	SendTimeout         time.Duration
+	StatusAll           bool
+	StatusOutput        string
+	StatusTimeout       time.Duration
+	VolumeDB            string
+	WatchBindAddr       string
+	WatchHealthInterval time.Duration
+	WatchOutput         string
 
 	conf *config.Config
 )
 
 func init() {
 	cobra.OnInitialize(
-		setupConfig,
 		setupLogger,
 	)
 }
@@ -43,26 +67,79 @@ func New() *cobra.Command {
 
 	RootCommand.PersistentFlags().BoolVar(&LogDebug, "log-debug", false, "Enable debug logging")
 	RootCommand.PersistentFlags().BoolVar(&LogJson, "log-json", false, "Enable JSON logging")
-	RootCommand.PersistentFlags().StringVar(&ConfigPath, "conf", "~/.conf/xmcctl.yaml", "Path to the conf file.")
+	RootCommand.PersistentFlags().StringVar(&ConfigPath, "conf", config.DefaultPath(), "Path to the conf file, created if it doesn't exist.")
+	RootCommand.PersistentFlags().StringVarP(&DeviceName, "device", "d", "", "Name or IP of the device to send commands to, instead of the selected device.")
 
 	discoverCommand := &cobra.Command{
-		Use:   "discover [flags] [ip...]",
+		Use:   "discover [flags] [ip|cidr...]",
 		Short: "Find Emotiva devices on the network.",
 		Long: `Searches for devices that respond to Emotiva's transponder identification packets.
 
-The broadcast IP address is used by default, which should find any devices on
-the local network. If IPs are supplied, those IPs will be attempted instead.
+By default a broadcast is sent to every IPv4 subnet of each local interface, or
+only those of the interface chosen with --interface, which should find any devices
+on the local network. If IPs are supplied, those IPs will be attempted instead.
+Networks like 10.20.0.0/24 can be supplied to probe every address in them, for
+devices on other subnets which broadcasts don't reach. Packets are sent at up to
+--rate per second.
 
-This command can be used to write any discovered devices to a conf file.
+This command can be used to write any discovered devices to a conf file. Found
+devices replace configured devices with the same IP, or the same name if that
+device's IP didn't respond. After a broadcast on every local interface, any
+configured devices which didn't respond are moved to the archive. Devices on a
+local subnet record the interface that subnet is on, devices reached through a
+router record none.
+
+With --refresh, every configured device is also probed directly and its ports and
+control version are updated in the conf file.
+
+With --watch, discovery repeats every --interval until interrupted, and devices are
+printed as they join, change IP or ports, or stop responding. Devices are written
+to the conf file as they're found when --write is also set.
 `,
 		RunE: discoverCmd,
 	}
+	discoverCommand.Flags().StringVarP(&DiscoverOutput, "output", "o", tableOutput, "Output format, one of "+strings.Join(outputFormats, ", ")+".")
 	discoverCommand.Flags().BoolVarP(&DiscoverWrite, "write", "w", false, "Write discovered devices to the conf file.")
 	discoverCommand.Flags().BoolVarP(&DiscoverRefresh, "refresh", "r", false, "Attempt to rediscover any configured devices.")
 	discoverCommand.Flags().BoolVarP(&DiscoverBroadcast, "broadcast", "B", false, "Always broadcast a discovery request.")
+	discoverCommand.Flags().StringVarP(&DiscoverInterface, "interface", "i", "", "Only broadcast on the subnets of this network interface. Devices are recorded with the interface of their subnet, if it's local.")
 	discoverCommand.Flags().StringVarP(&DiscoverBindAddr, "bind", "b", "0.0.0.0", "IP address to listen for discovery responses on.")
-	discoverCommand.Flags().DurationVarP(&DiscoverTimeout, "timeout", "t", 3*time.Second, "Maximum duration to wait for discovery responses.")
-	RootCommand.AddCommand(discoverCommand)
+	discoverCommand.Flags().StringVar(&DiscoverProtocol, "protocol", protov1.ProtocolVersion3, "Protocol version to request from devices, one of "+protov1.ProtocolVersion2+", "+protov1.ProtocolVersion3+". Devices advertise "+protov1.ProtocolVersion2+" if it's empty.")
+	discoverCommand.Flags().IntVar(&DiscoverRate, "rate", 200, "Maximum discovery packets to send per second, 0 for no limit.")
+	discoverCommand.Flags().IntVar(&DiscoverConcurrency, "concurrency", 16, "Maximum discovery packets to send at once, 0 for no limit.")
+	discoverCommand.Flags().BoolVar(&DiscoverWatch, "watch", false, "Keep sweeping for devices, printing each device that joins, changes or leaves.")
+	discoverCommand.Flags().DurationVar(&DiscoverInterval, "interval", remote.DefaultDiscoveryInterval, "Duration between sweeps with --watch.")
+	discoverCommand.Flags().DurationVarP(&DiscoverTimeout, "timeout", "t", 3*time.Second, "Maximum duration to wait for discovery responses after the last packet is sent.")
+
+	getCommand := &cobra.Command{
+		Use:   "get [flags] property...",
+		Short: "Print the current value of device properties.",
+		Long: `Requests the current value of each property from the selected device, without
+subscribing to changes.
+
+Properties are named by their notification tags, e.g. power, volume or source.
+`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: getCmd,
+	}
+	getCommand.Flags().DurationVarP(&GetTimeout, "timeout", "t", 3*time.Second, "Maximum duration to wait for the device to respond.")
+
+	// only commands which work with devices load the conf file, so help and version never touch it
+	deviceCommands := []*cobra.Command{
+		discoverCommand,
+		newDeviceCommand(),
+		getCommand,
+		newSendCommand(),
+		newStatusCommand(),
+		newWatchCommand(),
+	}
+	deviceCommands = append(deviceCommands, newControlCommands()...)
+	for _, c := range deviceCommands {
+		if c.PersistentPreRunE == nil {
+			c.PersistentPreRunE = loadConfig
+		}
+		RootCommand.AddCommand(c)
+	}
 
 	versionCommand := &cobra.Command{
 		Use:   "version",
@@ -74,8 +151,18 @@ This command can be used to write any discovered devices to a conf file.
 	return RootCommand
 }
 
-func setupConfig() {
-	conf = &config.Config{}
+// loadConfig loads the conf file, creating it if it doesn't exist
+func loadConfig(cmd *cobra.Command, args []string) error {
+	var err error
+	conf, err = config.LoadOrCreate(ConfigPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to load conf file")
+	}
+	logrus.WithFields(logrus.Fields{
+		"path":    ConfigPath,
+		"devices": len(conf.Devices),
+	}).Debug("loaded conf file")
+	return nil
 }
 
 func setupLogger() {
@@ -88,51 +175,249 @@ func setupLogger() {
 	}
 }
 
+// targetDevice returns the device commands should be sent to, which is the device named by --device,
+// the selected device, or the first configured device, in that order
+func targetDevice() (*protov1.Device, error) {
+	if DeviceName != "" {
+		rd, ok := conf.Device(DeviceName)
+		if !ok {
+			return nil, errors.New("device not found: " + DeviceName)
+		}
+		return protov1.NewDeviceFromRawDevice(rd)
+	}
+	if len(conf.Devices) == 0 {
+		return nil, errors.New("no devices configured, try running discover --write")
+	}
+	rd := &conf.Devices[0]
+	if conf.Selected != "" {
+		var ok bool
+		rd, ok = conf.Device(conf.Selected)
+		if !ok {
+			return nil, errors.New("selected device not found: " + conf.Selected)
+		}
+	}
+	return protov1.NewDeviceFromRawDevice(rd)
+}
+
+// updateConfig applies fn to the conf file while it's locked, so that changes made by other
+// invocations since it was loaded aren't lost, then replaces the loaded conf with the result. fn
+// returns config.ErrUnchanged to skip writing the file
+func updateConfig(fn func(c *config.Config) error) error {
+	written := true
+	c, err := config.Update(ConfigPath, func(c *config.Config) error {
+		err := fn(c)
+		if err == config.ErrUnchanged {
+			written = false
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "error updating conf file")
+	}
+	conf = c
+	if written {
+		logrus.WithFields(logrus.Fields{
+			"path": ConfigPath,
+		}).Debug("wrote conf file")
+	}
+	return nil
+}
+
 func versionCmd(cmd *cobra.Command, args []string) {
 	fmt.Println("no versions yet :(")
 }
 
 func discoverCmd(cmd *cobra.Command, args []string) error {
+	formats := outputFormats
+	if DiscoverWatch {
+		formats = []string{tableOutput, jsonOutput}
+	}
+	err := checkOutputFormat(DiscoverOutput, formats...)
+	if err != nil {
+		return err
+	}
+	if DiscoverRate < 0 || DiscoverConcurrency < 0 {
+		return errors.New("--rate and --concurrency can't be negative")
+	}
+	if DiscoverProtocol != "" && DiscoverProtocol != protov1.ProtocolVersion2 && DiscoverProtocol != protov1.ProtocolVersion3 {
+		return errors.New("unknown protocol version: " + DiscoverProtocol)
+	}
 	bindIP := net.ParseIP(DiscoverBindAddr)
 	if bindIP == nil {
 		return errors.New("unable to parse bind address: " + DiscoverBindAddr)
 	}
 
-	// args to this command should be IP addresses
+	// without any addresses to probe, every local subnet is searched
+	broadcast := DiscoverBroadcast || (len(args) == 0 && !DiscoverRefresh)
 	addrs := make([]net.IP, 0)
-	if len(args) > 0 {
-		if DiscoverBroadcast {
-			addrs = append(addrs, net.IPv4bcast)
+	seen := make(map[string]bool)
+	opts := discoveryOptions()
+	if broadcast {
+		broadcasts, err := broadcastAddrs()
+		if err != nil {
+			return err
 		}
-		for _, arg := range args {
-			ip := net.ParseIP(arg)
-			if ip == nil {
-				return errors.New("unable to parse ip address: " + arg)
+		for _, b := range broadcasts {
+			addrs = appendIP(addrs, seen, b.Broadcast)
+			// only devices on the chosen interface's subnets answer its broadcasts, responses are
+			// still received on every address since each subnet has its own
+			if DiscoverInterface != "" && b.Network != nil {
+				opts.Networks = append(opts.Networks, b.Network)
 			}
+		}
+	}
 
-			// don't add duplicate entries for the broadcast address
-			if DiscoverBroadcast {
-				if bytes.Compare(ip, net.IPv4bcast) == 0 {
-					continue
-				}
+	// args to this command should be IP addresses or networks in CIDR notation
+	for _, arg := range args {
+		if strings.Contains(arg, "/") {
+			_, network, err := net.ParseCIDR(arg)
+			if err != nil {
+				return errors.New("unable to parse network: " + arg)
 			}
-
-			addrs = append(addrs, ip)
+			hosts, err := remote.NetworkHosts(network)
+			if err != nil {
+				return err
+			}
+			for _, ip := range hosts {
+				addrs = appendIP(addrs, seen, ip)
+			}
+			continue
+		}
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return errors.New("unable to parse ip address: " + arg)
 		}
-	} else {
-		addrs = append(addrs, net.IPv4bcast)
+		addrs = appendIP(addrs, seen, ip)
+	}
+	// configured devices are probed directly when refreshing
+	if DiscoverRefresh {
+		for _, d := range conf.Devices {
+			ip := net.ParseIP(d.IP)
+			if ip == nil {
+				return errors.New("unable to parse ip address of configured device " + d.Name + ": " + d.IP)
+			}
+			addrs = appendIP(addrs, seen, ip)
+		}
+	}
+
+	if DiscoverWatch {
+		return discoverWatch(bindIP, addrs, opts)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DiscoverTimeout)
-	remotes, err := remote.DiscoverTransponders(ctx, bindIP, addrs)
+	// responses are awaited for --timeout after the last packet is sent
+	ctx, cancel := context.WithTimeout(context.Background(), opts.SendDuration(len(addrs))+DiscoverTimeout)
+	defer cancel()
+	devices, err := remote.DiscoverTranspondersWithOptions(ctx, bindIP, addrs, opts)
 	if err != nil {
-		cancel()
 		return errors.New("error discovering devices: " + err.Error())
 	}
 
-	for _, remote := range remotes {
-		fmt.Printf("%+v\n", remote)
+	found := make([]config.RawDevice, 0, len(devices))
+	for _, d := range devices {
+		found = append(found, d.RawDevice())
+	}
+	err = writeDevices(os.Stdout, DiscoverOutput, found)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if !DiscoverWrite && !DiscoverRefresh {
+		return nil
+	}
+	// only a broadcast on every local subnet gives every device a chance to respond, so only then are
+	// missing devices stale
+	sweep := broadcast && DiscoverInterface == ""
+
+	return updateConfig(func(c *config.Config) error {
+		results := make([]config.MergeResult, 0, 2)
+		changed := false
+		if DiscoverRefresh {
+			results = append(results, c.Refresh(found, DiscoverProtocol))
+		}
+		if DiscoverWrite {
+			results = append(results, c.Merge(found, DiscoverProtocol, sweep))
+		}
+		for _, result := range results {
+			logrus.WithFields(logrus.Fields{
+				"added":    result.Added,
+				"updated":  result.Updated,
+				"restored": result.Restored,
+				"archived": result.Archived,
+			}).Info("merged discovered devices")
+			changed = changed || result.Changed()
+		}
+		if !changed {
+			return config.ErrUnchanged
+		}
+		return nil
+	})
+}
+
+// broadcastAddrs returns the broadcast address of each subnet of the interface chosen with
+// --interface, or of every local interface. The limited broadcast address is used if no interfaces
+// have IPv4 subnets
+func broadcastAddrs() ([]remote.BroadcastAddr, error) {
+	broadcasts, err := remote.InterfaceBroadcasts(DiscoverInterface)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find broadcast addresses")
+	}
+	if len(broadcasts) == 0 {
+		broadcasts = append(broadcasts, remote.BroadcastAddr{Broadcast: net.IPv4bcast})
+	}
+	for _, b := range broadcasts {
+		logrus.WithFields(logrus.Fields{
+			"interface": b.Interface,
+			"broadcast": b.Broadcast.String(),
+		}).Debug("broadcasting discovery request")
+	}
+	return broadcasts, nil
+}
+
+// discoveryOptions returns the limits on sending discovery packets chosen with flags
+func discoveryOptions() remote.DiscoveryOptions {
+	return remote.DiscoveryOptions{
+		Rate:        DiscoverRate,
+		Concurrency: DiscoverConcurrency,
+		Protocol:    DiscoverProtocol,
+	}
+}
+
+// appendIP appends ip to ips unless it's in seen, the string form of every IP already appended
+func appendIP(ips []net.IP, seen map[string]bool, ip net.IP) []net.IP {
+	key := ip.String()
+	if seen[key] {
+		return ips
+	}
+	seen[key] = true
+	return append(ips, ip)
+}
+
+func getCmd(cmd *cobra.Command, args []string) error {
+	tags := make([]protov1.NotificationTag, 0, len(args))
+	for _, arg := range args {
+		tag, err := protov1.ParseNotificationTag(arg)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+	}
+
+	device, err := targetDevice()
+	if err != nil {
+		return err
+	}
+	r := remote.NewRemoteFromDevice(device)
+
+	ctx, cancel := context.WithTimeout(context.Background(), GetTimeout)
+	defer cancel()
+	resp, err := r.Update(ctx, tags...)
+	if err != nil {
+		return errors.Wrap(err, "error requesting properties from "+device.Name)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, p := range resp.Properties {
+		fmt.Fprintf(w, "%s\t%s\n", p.Tag, p.Value)
+	}
+	return w.Flush()
 }
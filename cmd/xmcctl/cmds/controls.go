@@ -0,0 +1,206 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newControlCommands makes the commands for everyday control of the selected device
+func newControlCommands() []*cobra.Command {
+	powerCommand := &cobra.Command{
+		Use:       "power on|off|toggle",
+		Short:     "Turn the device on or off.",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"on", "off", "toggle"},
+		RunE:      powerCmd,
+	}
+
+	volumeCommand := &cobra.Command{
+		Use:   "volume [flags] percent|+dB|-dB",
+		Short: "Set or step the volume.",
+		Long: `Sets the volume as a percentage of the device's range, or steps it up or down
+by a number of dB when the level is signed. Percentages are mapped linearly onto
+the range of -96 to +11 dB, so 0 is -96 dB, 50 is -42.5 dB and 100 is +11 dB.
+The volume can be set to an exact level in dB with --db instead.
+`,
+		Example: "  xmcctl volume 42\n  xmcctl volume +3\n  xmcctl volume -1.5\n  xmcctl volume --db -30",
+		// negative steps look like shorthand flags, so flags are parsed by the command itself
+		DisableFlagParsing: true,
+		PersistentPreRunE:  parseSignedNumberFlags,
+		RunE:               volumeCmd,
+	}
+	volumeCommand.Flags().StringVar(&VolumeDB, "db", "", "Set the volume to an exact level in dB.")
+
+	muteCommand := &cobra.Command{
+		Use:       "mute on|off|toggle",
+		Short:     "Mute or unmute the device.",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"on", "off", "toggle"},
+		RunE:      muteCmd,
+	}
+
+	inputCommand := &cobra.Command{
+		Use:   "input name",
+		Short: "Select an input.",
+		Long: `Selects an input by its name, like hdmi3, coax1 or tuner, or by the label
+assigned to a source on the device, like "Apple TV". Zone 2 has its own inputs,
+including follow_main to play whatever the main zone is playing.
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: inputCmd,
+	}
+
+	modeCommand := &cobra.Command{
+		Use:   "mode name",
+		Short: "Select a surround mode.",
+		Long: `Selects a surround mode, one of movie, music, dolby, dts, direct, auto,
+all_stereo or reference_stereo.
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: modeCmd,
+	}
+
+	commands := []*cobra.Command{powerCommand, volumeCommand, muteCommand, inputCommand, modeCommand}
+	for _, c := range commands {
+		c.Flags().DurationVarP(&ControlTimeout, "timeout", "t", 3*time.Second, "Maximum duration to wait for the device to respond.")
+		c.Flags().StringVarP(&ControlZone, "zone", "z", "main", "Zone to control, main or 2.")
+	}
+	return commands
+}
+
+// targetRemote returns a Remote for the device commands should be sent to
+func targetRemote() (*remote.Remote, error) {
+	device, err := targetDevice()
+	if err != nil {
+		return nil, err
+	}
+	return remote.NewRemoteFromDevice(device), nil
+}
+
+// targetZone returns the zone chosen with --zone of the device commands should be sent to
+func targetZone() (*remote.Zone, error) {
+	id, err := remote.ParseZone(ControlZone)
+	if err != nil {
+		return nil, err
+	}
+	r, err := targetRemote()
+	if err != nil {
+		return nil, err
+	}
+	return r.Zone(id)
+}
+
+func powerCmd(cmd *cobra.Command, args []string) error {
+	z, err := targetZone()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ControlTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "toggle":
+		on, err := z.TogglePower(ctx)
+		if err != nil {
+			return errors.Wrap(err, "error toggling power of "+z.String())
+		}
+		fmt.Println(onOff(on))
+		return nil
+	default:
+		err = z.Power(ctx, args[0] == "on")
+	}
+	return errors.Wrap(err, "error setting power of "+z.String())
+}
+
+func volumeCmd(cmd *cobra.Command, args []string) error {
+	args = cmd.Flags().Args()
+	if len(args) > 1 {
+		return errors.Errorf("accepts at most 1 arg, received %d", len(args))
+	}
+	if (len(args) == 0) == (VolumeDB == "") {
+		return errors.New("either a volume level or --db is required")
+	}
+	z, err := targetZone()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ControlTimeout)
+	defer cancel()
+
+	if VolumeDB != "" {
+		db, err := strconv.ParseFloat(VolumeDB, 64)
+		if err != nil {
+			return errors.New("unable to parse volume: " + VolumeDB)
+		}
+		return errors.Wrap(z.SetVolume(ctx, db), "error setting volume of "+z.String())
+	}
+
+	level, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return errors.New("unable to parse volume: " + args[0])
+	}
+	if strings.HasPrefix(args[0], "+") || strings.HasPrefix(args[0], "-") {
+		return errors.Wrap(z.StepVolume(ctx, level), "error stepping volume of "+z.String())
+	}
+	db, err := remote.VolumeFromPercent(level)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(z.SetVolume(ctx, db), "error setting volume of "+z.String())
+}
+
+func muteCmd(cmd *cobra.Command, args []string) error {
+	z, err := targetZone()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ControlTimeout)
+	defer cancel()
+
+	if args[0] == "toggle" {
+		err = z.ToggleMute(ctx)
+	} else {
+		err = z.Mute(ctx, args[0] == "on")
+	}
+	return errors.Wrap(err, "error setting mute of "+z.String())
+}
+
+func inputCmd(cmd *cobra.Command, args []string) error {
+	z, err := targetZone()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ControlTimeout)
+	defer cancel()
+	return errors.Wrap(z.SetInput(ctx, args[0]), "error selecting input of "+z.String())
+}
+
+func modeCmd(cmd *cobra.Command, args []string) error {
+	z, err := remote.ParseZone(ControlZone)
+	if err != nil {
+		return err
+	}
+	if z != remote.MainZone {
+		return errors.New("surround modes can only be selected for the main zone")
+	}
+	r, err := targetRemote()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ControlTimeout)
+	defer cancel()
+	return errors.Wrap(r.SetMode(ctx, args[0]), "error selecting mode of "+r.Name)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,152 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/config"
+	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func newDeviceCommand() *cobra.Command {
+	deviceCommand := &cobra.Command{
+		Use:   "device",
+		Short: "Manage the devices in the conf file.",
+		Long: `Lists and manages the devices in the conf file.
+
+Devices are referred to by name or IP. Commands are sent to the selected device,
+unless another is chosen with --device. Archived devices are kept in the conf
+file but aren't used until they're restored.
+`,
+	}
+
+	listCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List configured devices and whether they're reachable.",
+		Args:  cobra.NoArgs,
+		RunE:  deviceListCmd,
+	}
+	listCommand.Flags().BoolVarP(&DeviceListArchived, "archived", "a", false, "Include archived devices.")
+	listCommand.Flags().DurationVarP(&DeviceListTimeout, "timeout", "t", time.Second, "Maximum duration to wait for devices to respond, 0 to skip checking.")
+	deviceCommand.AddCommand(listCommand)
+
+	deviceCommand.AddCommand(&cobra.Command{
+		Use:   "select device",
+		Short: "Set the device commands are sent to by default.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateConfig(func(c *config.Config) error {
+				return c.Select(args[0])
+			})
+		},
+	})
+	deviceCommand.AddCommand(&cobra.Command{
+		Use:   "rename device name",
+		Short: "Rename a device.",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateConfig(func(c *config.Config) error {
+				return c.Rename(args[0], args[1])
+			})
+		},
+	})
+	deviceCommand.AddCommand(&cobra.Command{
+		Use:   "archive device...",
+		Short: "Move devices to the archive.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateConfig(func(c *config.Config) error {
+				for _, arg := range args {
+					err := c.ArchiveDevice(arg)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	})
+	deviceCommand.AddCommand(&cobra.Command{
+		Use:   "restore device...",
+		Short: "Move archived devices back to the active devices.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateConfig(func(c *config.Config) error {
+				for _, arg := range args {
+					err := c.RestoreDevice(arg)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	})
+	deviceCommand.AddCommand(&cobra.Command{
+		Use:   "remove device...",
+		Short: "Delete devices from the conf file.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateConfig(func(c *config.Config) error {
+				for _, arg := range args {
+					err := c.RemoveDevice(arg)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+	})
+
+	return deviceCommand
+}
+
+func deviceListCmd(cmd *cobra.Command, args []string) error {
+	reachable := make(map[string]bool)
+	if DeviceListTimeout > 0 && len(conf.Devices) > 0 {
+		addrs := make([]net.IP, 0, len(conf.Devices))
+		for _, d := range conf.Devices {
+			if ip := net.ParseIP(d.IP); ip != nil {
+				addrs = append(addrs, ip)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DeviceListTimeout)
+		defer cancel()
+		devices, err := remote.DiscoverTransponders(ctx, net.IPv4zero, addrs)
+		if err != nil {
+			return errors.Wrap(err, "error checking devices")
+		}
+		for _, d := range devices {
+			reachable[d.IP.String()] = true
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tNAME\tMODEL\tIP\tVERSION\tSTATUS")
+	for _, d := range conf.Devices {
+		selected := ""
+		if d.Name == conf.Selected {
+			selected = "*"
+		}
+		status := "unknown"
+		if DeviceListTimeout > 0 {
+			status = "unreachable"
+			if ip := net.ParseIP(d.IP); ip != nil && reachable[ip.String()] {
+				status = "reachable"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", selected, d.Name, d.Model, d.IP, d.ControlVersion, status)
+	}
+	if DeviceListArchived {
+		for _, d := range conf.Archive {
+			fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%s\n", d.Name, d.Model, d.IP, d.ControlVersion, "archived")
+		}
+	}
+	return w.Flush()
+}
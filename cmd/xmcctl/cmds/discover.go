@@ -0,0 +1,96 @@
+package cmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/config"
+	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// discoveryEvent is how discover --watch prints a DiscoveryEvent as JSON
+type discoveryEvent struct {
+	Time   time.Time     `json:"time"`
+	Event  string        `json:"event"`
+	Device printedDevice `json:"device"`
+}
+
+// discoverWatch sweeps for devices every DiscoverInterval until interrupted, printing each device
+// which joins, changes or leaves the network. Each sweep sends discovery packets to addrs with opts
+func discoverWatch(bindIP net.IP, addrs []net.IP, opts remote.DiscoveryOptions) error {
+	d := remote.NewDiscoverer(bindIP, addrs)
+	d.Interval = DiscoverInterval
+	d.SweepTimeout = DiscoverTimeout
+	d.Options = opts
+	if d.Options.SendDuration(len(addrs))+d.SweepTimeout >= d.Interval {
+		return errors.New("sending to every address and waiting --timeout must take less than --interval")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- d.Run(ctx)
+	}()
+
+	for e := range d.Events() {
+		device := e.Device.RawDevice()
+		err := printDiscoveryEvent(e.Type, device)
+		if err != nil {
+			return err
+		}
+		// a device which stopped responding may only be off, so it's left in the conf file
+		if !DiscoverWrite || e.Type == remote.DeviceRemoved {
+			continue
+		}
+		err = updateConfig(func(c *config.Config) error {
+			if !c.Merge([]config.RawDevice{device}, opts.Protocol, false).Changed() {
+				return config.ErrUnchanged
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"device": device.Name,
+				"err":    err,
+			}).Error("unable to write discovered device")
+		}
+	}
+
+	err := <-ran
+	if err != nil {
+		return errors.Wrap(err, "error discovering devices")
+	}
+	return nil
+}
+
+func printDiscoveryEvent(t remote.DiscoveryEventType, d config.RawDevice) error {
+	now := time.Now()
+	if DiscoverOutput == jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(discoveryEvent{
+			Time:   now,
+			Event:  t.String(),
+			Device: printedDevice(d),
+		})
+	}
+	_, err := fmt.Printf("%s  %-7s  %s  %s  %s  %s\n", now.Format("2006-01-02T15:04:05.000Z07:00"), t, d.Name, d.Model, d.IP, d.ControlVersion)
+	return err
+}
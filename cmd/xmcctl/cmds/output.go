@@ -0,0 +1,151 @@
+package cmds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/config"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats selected with -o
+const (
+	tableOutput = "table"
+	jsonOutput  = "json"
+	yamlOutput  = "yaml"
+	// nameOutput prints just the name of each item, one per line
+	nameOutput = "name"
+)
+
+// outputFormats are the formats supported by writeOutput
+var outputFormats = []string{tableOutput, jsonOutput, yamlOutput, nameOutput}
+
+// view is how a value is printed in the formats which aren't encoded directly from it
+type view struct {
+	// header holds the column names of the table
+	header []string
+	// rows holds the columns of each row of the table
+	rows [][]string
+	// names are printed one per line for the name format
+	names []string
+}
+
+// checkOutputFormat returns an error if format isn't one of formats, so that a bad -o flag is
+// reported before any devices are contacted
+func checkOutputFormat(format string, formats ...string) error {
+	for _, f := range formats {
+		if f == format {
+			return nil
+		}
+	}
+	return errors.Errorf("unknown output format %q, expected one of %s", format, strings.Join(formats, ", "))
+}
+
+// writeOutput writes v to w in format. JSON and YAML are encoded from v, while tables and names are
+// written from vw
+func writeOutput(w io.Writer, format string, v interface{}, vw view) error {
+	switch format {
+	case tableOutput:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		if len(vw.header) > 0 {
+			fmt.Fprintln(tw, strings.Join(vw.header, "\t"))
+		}
+		for _, row := range vw.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	case jsonOutput:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case yamlOutput:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		err := enc.Encode(v)
+		if err != nil {
+			return err
+		}
+		return enc.Close()
+	case nameOutput:
+		for _, name := range vw.names {
+			_, err := fmt.Fprintln(w, name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New("unknown output format: " + format)
+}
+
+// printedDevice is how devices are encoded for JSON and YAML output
+type printedDevice struct {
+	Name           string `json:"name" yaml:"name"`
+	Model          string `json:"model" yaml:"model"`
+	IP             string `json:"ip" yaml:"ip"`
+	ControlVersion string `json:"controlVersion" yaml:"control-version"`
+	ControlPort    int    `json:"controlPort" yaml:"control-port"`
+	NotifyPort     int    `json:"notifyPort" yaml:"notify-port"`
+	InfoPort       int    `json:"infoPort" yaml:"info-port"`
+	SetupPort      int    `json:"setupPort" yaml:"setup-port"`
+	KeepAlive      int    `json:"keepAlive,omitempty" yaml:"keep-alive,omitempty"`
+	Interface      string `json:"interface,omitempty" yaml:"interface,omitempty"`
+}
+
+// writeDevices writes devices to w in format, sorted by IP
+func writeDevices(w io.Writer, format string, devices []config.RawDevice) error {
+	sorted := make([]config.RawDevice, len(devices))
+	copy(sorted, devices)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareIPs(sorted[i].IP, sorted[j].IP) < 0
+	})
+
+	printed := make([]printedDevice, 0, len(sorted))
+	vw := view{
+		header: []string{"NAME", "MODEL", "IP", "VERSION", "CONTROL", "NOTIFY", "INFO", "SETUP", "INTERFACE"},
+	}
+	for _, d := range sorted {
+		printed = append(printed, printedDevice(d))
+		vw.rows = append(vw.rows, []string{
+			d.Name,
+			d.Model,
+			d.IP,
+			d.ControlVersion,
+			formatPort(d.ControlPort),
+			formatPort(d.NotifyPort),
+			formatPort(d.InfoPort),
+			formatPort(d.SetupPort),
+			d.Interface,
+		})
+		vw.names = append(vw.names, d.Name)
+	}
+	return writeOutput(w, format, printed, vw)
+}
+
+// compareIPs orders IPs numerically, with unparseable IPs ordered last by their text
+func compareIPs(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	switch {
+	case ipA == nil && ipB == nil:
+		return strings.Compare(a, b)
+	case ipA == nil:
+		return 1
+	case ipB == nil:
+		return -1
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16())
+}
+
+func formatPort(port int) string {
+	if port == 0 {
+		return "-"
+	}
+	return strconv.Itoa(port)
+}
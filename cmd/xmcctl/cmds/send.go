@@ -0,0 +1,69 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func newSendCommand() *cobra.Command {
+	sendCommand := &cobra.Command{
+		Use:   "send [flags] command [value]",
+		Short: "Send any command to the selected device.",
+		Long: `Sends a single command to the selected device and prints whether the device
+acknowledged it.
+
+Commands are named by their command tags, e.g. power_on, volume or hdmi1. The
+value defaults to 0, which most commands ignore. Relative commands like volume
+take a signed step as their value.
+`,
+		Args:    cobra.RangeArgs(1, 2),
+		RunE:    sendCmd,
+		Example: "  xmcctl send power_on\n  xmcctl send volume -- -2\n  xmcctl send set_volume -- -30.5",
+	}
+	sendCommand.Flags().BoolVar(&SendNoAck, "no-ack", false, "Don't ask the device to acknowledge the command.")
+	sendCommand.Flags().DurationVarP(&SendTimeout, "timeout", "t", 3*time.Second, "Maximum duration to wait for the device to acknowledge the command.")
+	return sendCommand
+}
+
+func sendCmd(cmd *cobra.Command, args []string) error {
+	tag, err := protov1.ParseCommandTag(args[0])
+	if err != nil {
+		if suggestions := protov1.SuggestCommandTags(args[0]); len(suggestions) > 0 {
+			return errors.Errorf("%v, did you mean: %s", err, strings.Join(suggestions, ", "))
+		}
+		return err
+	}
+	value := ""
+	if len(args) > 1 {
+		value = args[1]
+	}
+
+	device, err := targetDevice()
+	if err != nil {
+		return err
+	}
+	r := remote.NewRemoteFromDevice(device)
+
+	ctx, cancel := context.WithTimeout(context.Background(), SendTimeout)
+	defer cancel()
+	resp, err := r.SendBatch(ctx, []protov1.Command{{Tag: tag, Value: value, Ack: !SendNoAck}})
+	if resp != nil {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, a := range resp.Acks {
+			fmt.Fprintf(w, "%s\t%s\n", a.Tag, a.Status)
+		}
+		w.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "error sending "+tag.String()+" to "+device.Name)
+	}
+	return nil
+}
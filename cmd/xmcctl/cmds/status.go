@@ -0,0 +1,139 @@
+package cmds
+
+import (
+	"context"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+// deviceStatus is the current value of every property of a device
+type deviceStatus struct {
+	Name       string            `json:"name" yaml:"name"`
+	IP         string            `json:"ip" yaml:"ip"`
+	Properties map[string]string `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Error      string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func newStatusCommand() *cobra.Command {
+	statusCommand := &cobra.Command{
+		Use:   "status",
+		Short: "Print the current state of the selected device.",
+		Long: `Requests the current value of every property from the selected device, or from
+every configured device with --all, and prints them as a table, JSON or YAML.
+
+Exits non-zero if any device doesn't respond.
+`,
+		Args: cobra.NoArgs,
+		RunE: statusCmd,
+	}
+	statusCommand.Flags().BoolVarP(&StatusAll, "all", "A", false, "Print the state of every configured device.")
+	statusCommand.Flags().StringVarP(&StatusOutput, "output", "o", tableOutput, "Output format, one of "+strings.Join(outputFormats, ", ")+".")
+	statusCommand.Flags().DurationVarP(&StatusTimeout, "timeout", "t", 3*time.Second, "Maximum duration to wait for devices to respond.")
+	return statusCommand
+}
+
+func statusCmd(cmd *cobra.Command, args []string) error {
+	err := checkOutputFormat(StatusOutput, outputFormats...)
+	if err != nil {
+		return err
+	}
+
+	devices := make([]*protov1.Device, 0)
+	if StatusAll {
+		for i := range conf.Devices {
+			d, err := protov1.NewDeviceFromRawDevice(&conf.Devices[i])
+			if err != nil {
+				return errors.Wrap(err, "error loading device "+conf.Devices[i].Name)
+			}
+			devices = append(devices, d)
+		}
+		if len(devices) == 0 {
+			return errors.New("no devices configured, try running discover --write")
+		}
+	} else {
+		d, err := targetDevice()
+		if err != nil {
+			return err
+		}
+		devices = append(devices, d)
+	}
+
+	tags := make([]protov1.NotificationTag, len(protov1.NotificationTagStrings))
+	for i := range protov1.NotificationTagStrings {
+		tags[i] = protov1.NotificationTag(i)
+	}
+
+	// devices reply to the same local port number, so they're queried one at a time
+	statuses := make([]deviceStatus, 0, len(devices))
+	for _, d := range devices {
+		statuses = append(statuses, queryStatus(d, tags))
+	}
+
+	var v interface{} = statuses
+	if !StatusAll {
+		v = statuses[0]
+	}
+	err = writeOutput(os.Stdout, StatusOutput, v, statusView(statuses, tags))
+	if err != nil {
+		return err
+	}
+
+	failed := make([]string, 0)
+	for _, s := range statuses {
+		if s.Error != "" {
+			failed = append(failed, s.Name+": "+s.Error)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("error requesting status from " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// queryStatus requests the current value of tags from d
+func queryStatus(d *protov1.Device, tags []protov1.NotificationTag) deviceStatus {
+	s := deviceStatus{
+		Name: d.Name,
+		IP:   d.IP.String(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), StatusTimeout)
+	defer cancel()
+	resp, err := remote.NewRemoteFromDevice(d).Update(ctx, tags...)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Properties = make(map[string]string, len(resp.Properties))
+	for _, p := range resp.Properties {
+		s.Properties[p.Tag.String()] = p.Value
+	}
+	return s
+}
+
+// statusView has a row for each property with a column for each device
+func statusView(statuses []deviceStatus, tags []protov1.NotificationTag) view {
+	vw := view{
+		header: []string{"PROPERTY"},
+	}
+	for _, s := range statuses {
+		vw.header = append(vw.header, strings.ToUpper(s.Name))
+		vw.names = append(vw.names, s.Name)
+	}
+	for _, tag := range tags {
+		row := []string{tag.String()}
+		for _, s := range statuses {
+			value, ok := s.Properties[tag.String()]
+			if !ok {
+				value = "-"
+			}
+			row = append(row, value)
+		}
+		vw.rows = append(vw.rows, row)
+	}
+	return vw
+}
@@ -0,0 +1,269 @@
+package cmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"git.poundadm.net/anachronism/xmcctl/pkg/remote"
+	"git.poundadm.net/anachronism/xmcctl/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Output formats for watch, which prints a line per change
+const (
+	textOutput = "text"
+	// jsonLinesOutput is selected with -o json, printing a JSON object per line
+	jsonLinesOutput = "json"
+)
+
+// watchEvent is a single property change printed by watch
+type watchEvent struct {
+	Time     time.Time `json:"time"`
+	Device   string    `json:"device"`
+	Property string    `json:"property"`
+	Value    string    `json:"value"`
+	Visible  bool      `json:"visible"`
+}
+
+func newWatchCommand() *cobra.Command {
+	watchCommand := &cobra.Command{
+		Use:   "watch [flags] [property...]",
+		Short: "Print changes to device properties as they happen.",
+		Long: `Subscribes to properties of the selected device and prints each change as it's
+notified, until interrupted. Every property is watched unless some are named.
+
+The device is checked every --health-interval, and if it restarts or stops
+responding and comes back, the subscriptions are sent again. They're also sent
+again if the device advertised a keepAlive period and sends no notifications
+for several of them, since a restarted device forgets its subscriptions.
+`,
+		RunE: watchCmd,
+	}
+	watchCommand.Flags().StringVarP(&WatchOutput, "output", "o", textOutput, "Output format, one of text or json.")
+	watchCommand.Flags().DurationVar(&WatchHealthInterval, "health-interval", 10*time.Second, "How often to check the device is responding, 0 to disable.")
+	watchCommand.Flags().StringVarP(&WatchBindAddr, "bind", "b", "0.0.0.0", "IP address to listen for notifications on.")
+	return watchCommand
+}
+
+func watchCmd(cmd *cobra.Command, args []string) error {
+	err := checkOutputFormat(WatchOutput, textOutput, jsonLinesOutput)
+	if err != nil {
+		return err
+	}
+	bindIP := net.ParseIP(WatchBindAddr)
+	if bindIP == nil {
+		return errors.New("unable to parse bind address: " + WatchBindAddr)
+	}
+
+	tags := make([]protov1.NotificationTag, 0, len(args))
+	for _, arg := range args {
+		tag, err := protov1.ParseNotificationTag(arg)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		for i := range protov1.NotificationTagStrings {
+			tags = append(tags, protov1.NotificationTag(i))
+		}
+	}
+
+	device, err := targetDevice()
+	if err != nil {
+		return err
+	}
+
+	// devices reply to the port numbers they use themselves
+	srv := server.NewServer(bindIP)
+	srv.ControlPort = device.ControlAddr.Port
+	srv.NotifyPort = device.NotifyAddr.Port
+	err = srv.Listen()
+	if err != nil {
+		return errors.Wrap(err, "unable to listen for notifications")
+	}
+	d, err := srv.RegisterDevice(*device)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	sub, err := srv.Subscribe(device.IP, server.SubscribeOptions{BufferSize: server.DefaultBufferSize, Policy: server.BlockPolicy}, tags...)
+	if err != nil {
+		return errors.Wrap(err, "error subscribing to "+device.Name)
+	}
+	defer sub.Close()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	var health <-chan time.Time
+	if WatchHealthInterval > 0 {
+		ticker := time.NewTicker(WatchHealthInterval)
+		defer ticker.Stop()
+		health = ticker.C
+	}
+
+	// devices subscribed to send a keepAlive notification every period they advertised
+	var keepAlive <-chan time.Time
+	if device.KeepAlive > 0 {
+		ticker := time.NewTicker(device.KeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	w := &watchState{device: d, server: srv, lastSequence: -1, lastNotified: time.Now()}
+	for {
+		select {
+		case sig := <-interrupts:
+			logrus.WithFields(logrus.Fields{
+				"signal": sig.String(),
+			}).Debug("unsubscribing and exiting")
+			return nil
+		case prop, ok := <-sub.C:
+			if !ok {
+				return errors.New("subscription to " + device.Name + " closed")
+			}
+			err := printWatchEvent(device.Name, prop)
+			if err != nil {
+				return err
+			}
+		case n := <-d.Notifications:
+			w.notified(n)
+		case <-d.Updates:
+			w.responded()
+		case <-d.Controls:
+		case <-health:
+			w.check()
+		case <-keepAlive:
+			w.checkNotified()
+		}
+	}
+}
+
+// watchState follows whether a watched device is responding, and resubscribes once it's back after
+// restarting or going quiet
+type watchState struct {
+	device *server.RegisteredDevice
+	server *server.Server
+	// lastSequence is the sequence number of the last notification, or -1 before the first
+	lastSequence int
+	// lastNotified is when the last notification arrived, or when the subscriptions were last sent
+	lastNotified time.Time
+	// awaiting is set while a health check hasn't been answered
+	awaiting bool
+	// down is set once a health check went unanswered
+	down bool
+}
+
+// notified handles a notification, resubscribing if the sequence number went backwards because the
+// device restarted
+func (w *watchState) notified(n protov1.Notification) {
+	w.lastNotified = time.Now()
+	restarted := w.lastSequence >= 0 && n.Sequence < w.lastSequence
+	w.lastSequence = n.Sequence
+	if restarted {
+		logrus.WithFields(logrus.Fields{
+			"device":   w.device.Name,
+			"sequence": n.Sequence,
+		}).Info("notification sequence reset, device restarted")
+		w.resubscribe()
+		return
+	}
+	w.responded()
+}
+
+// responded records that the device sent something, resubscribing if it had stopped responding
+func (w *watchState) responded() {
+	w.awaiting = false
+	if !w.down {
+		return
+	}
+	w.down = false
+	logrus.WithFields(logrus.Fields{
+		"device": w.device.Name,
+	}).Info("device is responding again")
+	w.resubscribe()
+}
+
+// checkNotified resubscribes if the device has sent no notifications, not even keepAlives, for
+// remote.DefaultMissedKeepAlives of its keepAlive periods. A device which restarted has forgotten
+// its subscriptions, so it goes quiet even if it answers health checks
+func (w *watchState) checkNotified() {
+	quiet := time.Since(w.lastNotified)
+	if quiet < w.device.KeepAlive*remote.DefaultMissedKeepAlives {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"device": w.device.Name,
+		"quiet":  quiet.String(),
+	}).Info("no notifications from device, resubscribing")
+	// a restarted device starts its sequence numbers again
+	w.lastSequence = -1
+	w.lastNotified = time.Now()
+	w.resubscribe()
+}
+
+// check asks the device for its power state, marking it down if the last check wasn't answered
+func (w *watchState) check() {
+	if w.awaiting && !w.down {
+		w.down = true
+		logrus.WithFields(logrus.Fields{
+			"device": w.device.Name,
+		}).Warn("device isn't responding")
+	}
+	w.awaiting = true
+	err := w.server.Send(w.device.IP, protov1.UpdateRequest{
+		Protocol: w.device.Protocol(),
+		Tags:     []protov1.NotificationTag{protov1.PowerNotification},
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"device": w.device.Name,
+			"err":    err,
+		}).Warn("unable to check device")
+	}
+}
+
+func (w *watchState) resubscribe() {
+	err := w.server.Resubscribe(w.device.IP)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"device": w.device.Name,
+			"err":    err,
+		}).Warn("unable to resubscribe")
+	}
+}
+
+func printWatchEvent(device string, prop protov1.Property) error {
+	e := watchEvent{
+		Time:     time.Now(),
+		Device:   device,
+		Property: prop.Tag.String(),
+		Value:    prop.Value,
+		Visible:  prop.Visible,
+	}
+	if WatchOutput == jsonLinesOutput {
+		return json.NewEncoder(os.Stdout).Encode(e)
+	}
+	_, err := fmt.Printf("%s  %s  %s\n", e.Time.Format("2006-01-02T15:04:05.000Z07:00"), e.Property, e.Value)
+	return err
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"git.poundadm.net/anachronism/xmcctl/cmd/xmcctl/cmds"
+	"os"
 )
 
 func main() {
 	root := cmds.New()
-	root.Execute()
+	err := root.Execute()
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -1,8 +1,24 @@
 package config
 
 import (
-	"gopkg.in/yaml.v2"
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
 	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	// DefaultFilename is the name of the conf file in the default conf directory
+	DefaultFilename = "xmcctl.yaml"
+	// xdgDirectory and xdgFilename name the conf file within $XDG_CONFIG_HOME
+	xdgDirectory = "xmcctl"
+	xdgFilename  = "config.yaml"
 )
 
 // Config contains configuration parameters for the entire program, including previously
@@ -16,8 +32,18 @@ type Config struct {
 
 	// Archive is a list of devices which were previously discovered but no longer used.
 	Archive []RawDevice `yaml:"archive,omitempty"`
+
+	// doc is the document the Config was decoded from, so that comments and unknown keys survive
+	// being written back
+	doc *yaml.Node
+	// path is the file the Config was loaded from, if any
+	path string
 }
 
+// ErrUnchanged is returned by the function passed to Update when it didn't change the Config, so
+// the file doesn't need to be written
+var ErrUnchanged = errors.New("conf unchanged")
+
 // NewConfigFromDefaults make a Config with default values
 func NewConfigFromDefaults() *Config {
 	c := &Config{
@@ -31,22 +57,199 @@ func NewConfigFromDefaults() *Config {
 // NewConfigFromBytes makes a Config from the passed byte slice
 func NewConfigFromBytes(someBytes []byte) (*Config, error) {
 	c := NewConfigFromDefaults()
-	err := yaml.Unmarshal(someBytes, c)
-	return c, err
+	if len(bytes.TrimSpace(someBytes)) == 0 {
+		return c, nil
+	}
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(someBytes, doc)
+	if err != nil {
+		return c, err
+	}
+	err = doc.Decode(c)
+	if err != nil {
+		return c, err
+	}
+	c.doc = doc
+	return c, nil
 }
 
-// NewConfigFromFile makes a Config from the passed file
+// NewConfigFromFile makes a Config from the passed file. Decoding errors include the filename and
+// the line of the file they occurred on
 func NewConfigFromFile(filename string) (*Config, error) {
-	f, err := os.Open(filename)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConfigFromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	c.path = filename
+	return c, nil
+}
+
+// LoadOrCreate makes a Config from the passed file, after expanding a leading ~. If the file doesn't
+// exist, it's created with default values along with any missing parent directories
+func LoadOrCreate(filename string) (*Config, error) {
+	path, err := ExpandPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConfigFromFile(path)
+	if err == nil || !os.IsNotExist(err) {
+		return c, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// another process may create the file first, in which case it's loaded instead
+	return Update(path, func(c *Config) error { return nil })
+}
+
+// Update loads the passed file, after expanding a leading ~, passes it to fn, then writes the result
+// back to the file. The file is locked throughout, so concurrent updates are applied in turn rather
+// than overwriting each other. If the file doesn't exist, fn is passed a default Config. If fn returns
+// ErrUnchanged, the file isn't written unless it doesn't exist yet, and the Config is returned without
+// an error.
+func Update(filename string, fn func(c *Config) error) (*Config, error) {
+	path, err := ExpandPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := Lock(path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	c, err := NewConfigFromFile(path)
+	exists := !os.IsNotExist(err)
+	if !exists {
+		c = NewConfigFromDefaults()
+		c.path = path
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = fn(c)
+	if err == ErrUnchanged && exists {
+		return c, nil
+	} else if err != nil && err != ErrUnchanged {
+		return nil, err
+	}
+	err = c.WriteFile(path)
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, 0)
-	_, err = f.Read(b)
+	return c, nil
+}
+
+// Save writes the Config back to the file it was loaded from while holding the file's lock. Any
+// changes made to the file since it was loaded are overwritten, so prefer Update to modify it
+func (c *Config) Save() error {
+	if c.path == "" {
+		return errors.New("conf wasn't loaded from a file")
+	}
+	lock, err := Lock(c.path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return c.WriteFile(c.path)
+}
+
+// WriteFile atomically replaces the passed file with the Config, by writing to a temporary file in
+// the same directory and renaming it over the original. The original file's permissions are kept,
+// along with any comments and unknown keys in the document the Config was decoded from
+func (c *Config) WriteFile(filename string) error {
+	b, err := c.marshal()
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	// once renamed this fails harmlessly
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// marshal encodes the Config as YAML, merged into the document it was decoded from if there was one
+func (c *Config) marshal() ([]byte, error) {
+	node := &yaml.Node{}
+	err := node.Encode(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.doc != nil && len(c.doc.Content) > 0 {
+		mergeNode(c.doc.Content[0], node, reflect.TypeOf(c))
+		node = c.doc
+	}
+
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	err = enc.Encode(node)
 	if err != nil {
 		return nil, err
 	}
-	return NewConfigFromBytes(b)
+	err = enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DefaultPath returns the conf file path used when none is specified, which is
+// $XDG_CONFIG_HOME/xmcctl/config.yaml if it's set or in ~/.conf otherwise. The returned path may need
+// to be expanded with ExpandPath
+func DefaultPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, xdgDirectory, xdgFilename)
+	}
+	return filepath.Join("~", ".conf", DefaultFilename)
+}
+
+// ExpandPath replaces a leading ~ in path with the current user's home directory
+func ExpandPath(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", fmt.Errorf("unable to find home directory to expand %s: %v", path, err)
+		}
+		home = u.HomeDir
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
 }
 
 // RawDevice contains information for a specific transponder in unparsed form.
@@ -59,4 +262,11 @@ type RawDevice struct {
 	NotifyPort     int    `yaml:"notify-port,omitempty"`
 	InfoPort       int    `yaml:"info-port,omitempty"`
 	SetupPort      int    `yaml:"setup-port,omitempty"`
+	// KeepAlive is how often the device sends keepAlive notifications, in milliseconds as it
+	// advertises it
+	KeepAlive int `yaml:"keep-alive,omitempty"`
+	// Interface is the local network interface on the same subnet as the device when it was last
+	// discovered. It's found from the device's IP, not from where its response arrived, so devices
+	// reached through a router have none
+	Interface string `yaml:"interface,omitempty"`
 }
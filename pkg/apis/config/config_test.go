@@ -0,0 +1,108 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConf(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "xmcctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "xmcctl.yaml")
+	err = ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpdateKeepsComments(t *testing.T) {
+	path := writeConf(t, `# devices on the network
+devices:
+  # living room
+  - name: XMC-1
+    model: XMC-1
+    ip: 10.0.0.2 # reserved in dhcp
+  # theater
+  - name: XMC-1
+    model: XMC-1
+    ip: 10.0.0.3
+`)
+	_, err := Update(path, func(c *Config) error {
+		return c.Rename("10.0.0.3", "theater")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# devices on the network
+devices:
+  # living room
+  - name: XMC-1
+    model: XMC-1
+    ip: 10.0.0.2 # reserved in dhcp
+  # theater
+  - name: theater
+    model: XMC-1
+    ip: 10.0.0.3
+`
+	if string(b) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b, want)
+	}
+}
+
+func TestUpdateUnchanged(t *testing.T) {
+	path := writeConf(t, "devices:\n  - {name: living, ip: 10.0.0.2}\n")
+	old := time.Now().Add(-time.Hour)
+	err := os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Update(path, func(c *Config) error {
+		if c.Merge([]RawDevice{{Name: "living", IP: "10.0.0.2"}}, "", false).Changed() {
+			t.Error("merging an unchanged device changed the conf")
+		}
+		return ErrUnchanged
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Devices) != 1 {
+		t.Errorf("got devices %+v, want the loaded device", c.Devices)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Error("unchanged conf file was written")
+	}
+}
+
+func TestUpdateUnchangedCreates(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeConf(t, "")), "new.yaml")
+	_, err := Update(path, func(c *Config) error {
+		return ErrUnchanged
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "devices:") {
+		t.Errorf("got %q, want a default conf", b)
+	}
+}
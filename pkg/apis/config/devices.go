@@ -0,0 +1,107 @@
+package config
+
+import "errors"
+
+// FindDevice returns the index in devices of the device named ref, or failing that the device with
+// the IP ref, or -1 if there isn't one
+func FindDevice(devices []RawDevice, ref string) int {
+	for i := range devices {
+		if devices[i].Name == ref {
+			return i
+		}
+	}
+	for i := range devices {
+		if devices[i].IP == ref {
+			return i
+		}
+	}
+	return -1
+}
+
+// Device returns the active device with the name or IP ref
+func (c *Config) Device(ref string) (*RawDevice, bool) {
+	i := FindDevice(c.Devices, ref)
+	if i < 0 {
+		return nil, false
+	}
+	return &c.Devices[i], true
+}
+
+// Select makes the active device with the name or IP ref the default to send commands to
+func (c *Config) Select(ref string) error {
+	d, ok := c.Device(ref)
+	if !ok {
+		return errors.New("no active device named " + ref)
+	}
+	c.Selected = d.Name
+	return nil
+}
+
+// Rename changes the name of the active or archived device with the name or IP ref. The selected
+// device stays selected
+func (c *Config) Rename(ref string, name string) error {
+	if FindDevice(c.Devices, name) >= 0 || FindDevice(c.Archive, name) >= 0 {
+		return errors.New("a device is already named " + name)
+	}
+	d, ok := c.Device(ref)
+	if !ok {
+		i := FindDevice(c.Archive, ref)
+		if i < 0 {
+			return errors.New("no device named " + ref)
+		}
+		d = &c.Archive[i]
+	}
+	if c.Selected != "" && c.Selected == d.Name {
+		c.Selected = name
+	}
+	d.Name = name
+	return nil
+}
+
+// ArchiveDevice moves the active device with the name or IP ref to Archive. If it was selected, no
+// device is selected afterwards
+func (c *Config) ArchiveDevice(ref string) error {
+	i := FindDevice(c.Devices, ref)
+	if i < 0 {
+		return errors.New("no active device named " + ref)
+	}
+	d := c.Devices[i]
+	c.Devices = append(c.Devices[:i], c.Devices[i+1:]...)
+	c.archive(d)
+	if c.Selected == d.Name {
+		c.Selected = ""
+	}
+	return nil
+}
+
+// RestoreDevice moves the archived device with the name or IP ref back to Devices
+func (c *Config) RestoreDevice(ref string) error {
+	i := FindDevice(c.Archive, ref)
+	if i < 0 {
+		return errors.New("no archived device named " + ref)
+	}
+	d := c.Archive[i]
+	if FindDevice(c.Devices, d.Name) >= 0 {
+		return errors.New("an active device is already named " + d.Name)
+	}
+	c.Archive = append(c.Archive[:i], c.Archive[i+1:]...)
+	c.Devices = append(c.Devices, d)
+	return nil
+}
+
+// RemoveDevice deletes the active or archived device with the name or IP ref. Active devices are
+// matched first
+func (c *Config) RemoveDevice(ref string) error {
+	if i := FindDevice(c.Devices, ref); i >= 0 {
+		if c.Selected == c.Devices[i].Name {
+			c.Selected = ""
+		}
+		c.Devices = append(c.Devices[:i], c.Devices[i+1:]...)
+		return nil
+	}
+	if i := FindDevice(c.Archive, ref); i >= 0 {
+		c.Archive = append(c.Archive[:i], c.Archive[i+1:]...)
+		return nil
+	}
+	return errors.New("no device named " + ref)
+}
@@ -0,0 +1,32 @@
+package config
+
+import "os"
+
+// FileLock is an advisory lock on a conf file. The lock is held on a separate lock file, since the
+// conf file itself is replaced when it's written
+type FileLock struct {
+	f *os.File
+}
+
+// Lock waits for and acquires the lock on the passed conf file
+func Lock(filename string) (*FileLock, error) {
+	f, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
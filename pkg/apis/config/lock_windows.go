@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package config
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockRange is the number of bytes locked, LockFileEx locks byte ranges rather than whole files
+const lockRange = 1
+
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, lockRange, 0, &windows.Overlapped{})
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, lockRange, 0, &windows.Overlapped{})
+}
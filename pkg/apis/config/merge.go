@@ -0,0 +1,156 @@
+package config
+
+import "strconv"
+
+// MergeResult lists the names of the devices changed by Merge or Refresh
+type MergeResult struct {
+	Added    []string
+	Updated  []string
+	Restored []string
+	Archived []string
+}
+
+// Changed reports whether the Config was modified
+func (r MergeResult) Changed() bool {
+	return len(r.Added)+len(r.Updated)+len(r.Restored)+len(r.Archived) > 0
+}
+
+// Merge adds found devices to Devices. A found device updates the active device with the same IP,
+// or failing that the same name if that device's IP didn't respond, so devices which change IP are
+// followed but devices sharing a default name are kept apart. Archived devices which are found again
+// are restored. Matched devices keep their stored name, so renamed devices and Selected survive
+// discovery. protocol is the version the discovery packets requested, see controlVersion. Every
+// active device that wasn't found is moved to Archive if sweep is set, meaning every device on the
+// network had the chance to respond.
+func (c *Config) Merge(found []RawDevice, protocol string, sweep bool) MergeResult {
+	result := MergeResult{}
+	matched := make(map[int]bool)
+	foundIPs := make(map[string]bool, len(found))
+	for _, fd := range found {
+		foundIPs[fd.IP] = true
+	}
+
+	for _, fd := range found {
+		i := matchDevice(c.Devices, fd, foundIPs, matched)
+		if i >= 0 {
+			fd.Name = c.Devices[i].Name
+			// not every discovery response includes the setup port
+			if fd.SetupPort == 0 {
+				fd.SetupPort = c.Devices[i].SetupPort
+			}
+			if fd.KeepAlive == 0 {
+				fd.KeepAlive = c.Devices[i].KeepAlive
+			}
+			fd.ControlVersion = controlVersion(c.Devices[i].ControlVersion, fd.ControlVersion, protocol)
+			if c.Devices[i] != fd {
+				result.Updated = append(result.Updated, fd.Name)
+			}
+			c.Devices[i] = fd
+			matched[i] = true
+			continue
+		}
+
+		if j := matchDevice(c.Archive, fd, foundIPs, nil); j >= 0 {
+			fd.Name = c.Archive[j].Name
+			c.Archive = append(c.Archive[:j], c.Archive[j+1:]...)
+			result.Restored = append(result.Restored, fd.Name)
+		} else {
+			result.Added = append(result.Added, fd.Name)
+		}
+		c.Devices = append(c.Devices, fd)
+		matched[len(c.Devices)-1] = true
+	}
+
+	// an unmatched device sharing an IP with a found device is a duplicate entry replaced by it
+	active := make([]RawDevice, 0, len(c.Devices))
+	for i, d := range c.Devices {
+		if !matched[i] && (sweep || foundIPs[d.IP]) {
+			c.archive(d)
+			result.Archived = append(result.Archived, d.Name)
+			continue
+		}
+		active = append(active, d)
+	}
+	c.Devices = active
+	return result
+}
+
+// controlVersion returns the control version to store for a device stored with stored which
+// advertised found in reply to a discovery packet requesting protocol. Devices advertise protocol
+// 2.0 unless a later one is requested, so a lower version only replaces a higher one if the stored
+// version was requested, meaning the device no longer supports it
+func controlVersion(stored, found, protocol string) string {
+	s, err := strconv.ParseFloat(stored, 64)
+	if err != nil {
+		return found
+	}
+	f, err := strconv.ParseFloat(found, 64)
+	if err != nil {
+		return stored
+	}
+	if f >= s {
+		return found
+	}
+	if p, err := strconv.ParseFloat(protocol, 64); err == nil && p >= s {
+		return found
+	}
+	return stored
+}
+
+// Refresh updates the ports, control version and keepAlive of active devices from found devices
+// with the same IP, in reply to discovery packets requesting protocol. Devices which weren't found
+// are left unchanged
+func (c *Config) Refresh(found []RawDevice, protocol string) MergeResult {
+	result := MergeResult{}
+	for _, fd := range found {
+		for i := range c.Devices {
+			d := &c.Devices[i]
+			if d.IP != fd.IP {
+				continue
+			}
+			updated := *d
+			updated.ControlVersion = controlVersion(d.ControlVersion, fd.ControlVersion, protocol)
+			updated.ControlPort = fd.ControlPort
+			updated.NotifyPort = fd.NotifyPort
+			updated.InfoPort = fd.InfoPort
+			if fd.SetupPort != 0 {
+				updated.SetupPort = fd.SetupPort
+			}
+			if fd.KeepAlive != 0 {
+				updated.KeepAlive = fd.KeepAlive
+			}
+			if fd.Interface != "" {
+				updated.Interface = fd.Interface
+			}
+			if updated != *d {
+				*d = updated
+				result.Updated = append(result.Updated, d.Name)
+			}
+		}
+	}
+	return result
+}
+
+// matchDevice returns the index of the device in devices with the IP of d, or failing that the name
+// of d as long as that device's IP isn't in foundIPs and it isn't in taken, or -1 if there isn't one
+func matchDevice(devices []RawDevice, d RawDevice, foundIPs map[string]bool, taken map[int]bool) int {
+	if i := FindDevice(devices, d.IP); i >= 0 {
+		return i
+	}
+	i := FindDevice(devices, d.Name)
+	if i < 0 || taken[i] || foundIPs[devices[i].IP] {
+		return -1
+	}
+	return i
+}
+
+// archive adds d to Archive, replacing any archived device with the same IP
+func (c *Config) archive(d RawDevice) {
+	for i := range c.Archive {
+		if c.Archive[i].IP == d.IP {
+			c.Archive[i] = d
+			return
+		}
+	}
+	c.Archive = append(c.Archive, d)
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		devices  []RawDevice
+		archive  []RawDevice
+		found    []RawDevice
+		protocol string
+		sweep    bool
+		want     []RawDevice
+		archived []RawDevice
+	}{
+		{
+			name:    "new device",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2"}},
+			found:   []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2"}, {Name: "theater", IP: "10.0.0.3"}},
+		},
+		{
+			name:    "renamed device keeps its name",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2"}},
+			found:   []RawDevice{{Name: "XMC-1", IP: "10.0.0.2", ControlPort: 7002}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlPort: 7002}},
+		},
+		{
+			name:     "restored device keeps its name",
+			archive:  []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+			found:    []RawDevice{{Name: "XMC-1", IP: "10.0.0.3"}},
+			want:     []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+			archived: []RawDevice{},
+		},
+		{
+			name:    "device changed IP",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2"}},
+			found:   []RawDevice{{Name: "living", IP: "10.0.0.9"}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.9"}},
+		},
+		{
+			name:    "devices sharing a name",
+			devices: []RawDevice{{Name: "XMC-1", IP: "10.0.0.2", ControlPort: 7002}},
+			found:   []RawDevice{{Name: "XMC-1", IP: "10.0.0.3"}, {Name: "XMC-1", IP: "10.0.0.2"}},
+			want:    []RawDevice{{Name: "XMC-1", IP: "10.0.0.2"}, {Name: "XMC-1", IP: "10.0.0.3"}},
+		},
+		{
+			name:    "devices sharing a name found in order",
+			devices: []RawDevice{{Name: "XMC-1", IP: "10.0.0.2"}},
+			found:   []RawDevice{{Name: "XMC-1", IP: "10.0.0.2"}, {Name: "XMC-1", IP: "10.0.0.3"}},
+			want:    []RawDevice{{Name: "XMC-1", IP: "10.0.0.2"}, {Name: "XMC-1", IP: "10.0.0.3"}},
+		},
+		{
+			name:     "sweep archives missing devices",
+			devices:  []RawDevice{{Name: "living", IP: "10.0.0.2"}, {Name: "theater", IP: "10.0.0.3"}},
+			found:    []RawDevice{{Name: "living", IP: "10.0.0.2"}},
+			sweep:    true,
+			want:     []RawDevice{{Name: "living", IP: "10.0.0.2"}},
+			archived: []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+		},
+		{
+			name:     "archived device restored",
+			archive:  []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+			found:    []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+			want:     []RawDevice{{Name: "theater", IP: "10.0.0.3"}},
+			archived: []RawDevice{},
+		},
+		{
+			name:     "lower control version kept when 3.0 wasn't requested",
+			devices:  []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0", KeepAlive: 10000}},
+			found:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			protocol: "2.0",
+			want:     []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0", KeepAlive: 10000}},
+		},
+		{
+			name:     "lower control version stored when 3.0 was requested",
+			devices:  []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			found:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			protocol: "3.0",
+			want:     []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+		},
+		{
+			name:    "higher control version stored",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			found:   []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConfigFromDefaults()
+			c.Devices = append(c.Devices, tt.devices...)
+			c.Archive = append(c.Archive, tt.archive...)
+			c.Merge(tt.found, tt.protocol, tt.sweep)
+			if !reflect.DeepEqual(c.Devices, tt.want) {
+				t.Errorf("got devices %+v, want %+v", c.Devices, tt.want)
+			}
+			archived := tt.archived
+			if archived == nil {
+				archived = []RawDevice{}
+			}
+			if !reflect.DeepEqual(c.Archive, archived) {
+				t.Errorf("got archive %+v, want %+v", c.Archive, archived)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		devices  []RawDevice
+		found    []RawDevice
+		protocol string
+		want     []RawDevice
+		updated  []string
+	}{
+		{
+			name:    "ports updated",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2", ControlPort: 7002, SetupPort: 7100}},
+			found:   []RawDevice{{Name: "XMC-1", IP: "10.0.0.2", ControlPort: 17002, KeepAlive: 10000}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlPort: 17002, SetupPort: 7100, KeepAlive: 10000}},
+			updated: []string{"living"},
+		},
+		{
+			name:    "lower control version kept when no protocol was requested",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			found:   []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+		},
+		{
+			name:     "lower control version stored when 3.0 was requested",
+			devices:  []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			found:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			protocol: "3.0",
+			want:     []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			updated:  []string{"living"},
+		},
+		{
+			name:    "higher control version stored",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "2.0"}},
+			found:   []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			updated: []string{"living"},
+		},
+		{
+			name:    "missing device unchanged",
+			devices: []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+			found:   []RawDevice{{Name: "theater", IP: "10.0.0.3", ControlVersion: "2.0"}},
+			want:    []RawDevice{{Name: "living", IP: "10.0.0.2", ControlVersion: "3.0"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConfigFromDefaults()
+			c.Devices = append(c.Devices, tt.devices...)
+			result := c.Refresh(tt.found, tt.protocol)
+			if !reflect.DeepEqual(c.Devices, tt.want) {
+				t.Errorf("got devices %+v, want %+v", c.Devices, tt.want)
+			}
+			if !reflect.DeepEqual(result.Updated, tt.updated) {
+				t.Errorf("got updated %v, want %v", result.Updated, tt.updated)
+			}
+		})
+	}
+}
+
+func TestMergeAfterRename(t *testing.T) {
+	c := NewConfigFromDefaults()
+	c.Devices = []RawDevice{{Name: "XMC-1", IP: "10.0.0.2"}}
+	c.Selected = "XMC-1"
+	err := c.Rename("XMC-1", "theater")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := c.Merge([]RawDevice{{Name: "XMC-1", IP: "10.0.0.2", ControlPort: 7002}}, "3.0", true)
+	if !reflect.DeepEqual(result.Updated, []string{"theater"}) {
+		t.Errorf("got updated %v, want theater", result.Updated)
+	}
+	if c.Selected != "theater" {
+		t.Errorf("got selected %q, want theater", c.Selected)
+	}
+	d, ok := c.Device(c.Selected)
+	if !ok {
+		t.Fatal("selected device not found")
+	}
+	if d.ControlPort != 7002 {
+		t.Errorf("got control port %d, want 7002", d.ControlPort)
+	}
+}
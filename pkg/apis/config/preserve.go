@@ -0,0 +1,148 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+)
+
+// mergeNode updates dst, a node decoded from a conf file, to hold the values of src, a node encoded
+// from a value of type t. Comments and styles in dst are kept, as are mapping keys which t doesn't
+// have a field for
+func mergeNode(dst, src *yaml.Node, t reflect.Type) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if dst.Kind != src.Kind {
+		head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+		*dst = *src
+		dst.HeadComment, dst.LineComment, dst.FootComment = head, line, foot
+		return
+	}
+
+	switch src.Kind {
+	case yaml.DocumentNode:
+		if len(dst.Content) > 0 && len(src.Content) > 0 {
+			mergeNode(dst.Content[0], src.Content[0], t)
+		}
+	case yaml.MappingNode:
+		mergeMapping(dst, src, t)
+	case yaml.SequenceNode:
+		mergeSequence(dst, src, t)
+	default:
+		if dst.Tag != src.Tag {
+			dst.Style = src.Style
+		}
+		dst.Tag = src.Tag
+		dst.Value = src.Value
+	}
+}
+
+func mergeMapping(dst, src *yaml.Node, t reflect.Type) {
+	fields := yamlFields(t)
+	srcValues := make(map[string]*yaml.Node, len(src.Content)/2)
+	srcKeys := make([]*yaml.Node, 0, len(src.Content)/2)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		srcValues[src.Content[i].Value] = src.Content[i+1]
+		srcKeys = append(srcKeys, src.Content[i])
+	}
+
+	content := make([]*yaml.Node, 0, len(dst.Content))
+	merged := make(map[string]bool)
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		key, value := dst.Content[i], dst.Content[i+1]
+		if sv, ok := srcValues[key.Value]; ok {
+			mergeNode(value, sv, fields[key.Value])
+			content = append(content, key, value)
+			merged[key.Value] = true
+			continue
+		}
+		// known keys missing from src were left out as empty, unknown keys belong to the user
+		if _, known := fields[key.Value]; !known {
+			content = append(content, key, value)
+		}
+	}
+	for _, key := range srcKeys {
+		if !merged[key.Value] {
+			content = append(content, key, srcValues[key.Value])
+		}
+	}
+	dst.Content = content
+}
+
+// mergeSequence merges sequences item by item. Items which are mappings with an ip key are matched
+// by IP, so that comments stay with their device when devices are added, removed, reordered or
+// renamed. Other items are matched by position
+func mergeSequence(dst, src *yaml.Node, t reflect.Type) {
+	var elem reflect.Type
+	if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		elem = t.Elem()
+	}
+	if len(dst.Content) == 0 {
+		// an empty sequence is usually written in flow style, which suits its new items poorly
+		dst.Style = src.Style
+	}
+
+	byIP := make(map[string]*yaml.Node)
+	for _, item := range dst.Content {
+		if ip := ipOf(item); ip != "" {
+			if _, ok := byIP[ip]; !ok {
+				byIP[ip] = item
+			}
+		}
+	}
+
+	content := make([]*yaml.Node, 0, len(src.Content))
+	for i, sv := range src.Content {
+		var dv *yaml.Node
+		if ip := ipOf(sv); ip != "" {
+			dv = byIP[ip]
+			delete(byIP, ip)
+		} else if i < len(dst.Content) && ipOf(dst.Content[i]) == "" {
+			dv = dst.Content[i]
+		}
+		if dv == nil {
+			content = append(content, sv)
+			continue
+		}
+		mergeNode(dv, sv, elem)
+		content = append(content, dv)
+	}
+	dst.Content = content
+}
+
+// ipOf returns the value of the ip key of a mapping node, or an empty string
+func ipOf(n *yaml.Node) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "ip" {
+			return n.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// yamlFields maps the YAML keys of a struct type to the type of each field
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	if t == nil || t.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
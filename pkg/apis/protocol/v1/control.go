@@ -0,0 +1,111 @@
+package v1
+
+import "encoding/xml"
+
+const (
+	controlRequestElement  = "emotivaControl"
+	controlResponseElement = "emotivaAck"
+)
+
+// Command is a single command within a ControlRequest
+type Command struct {
+	Tag CommandTag
+	// Value is the argument to the command, devices treat an empty value as "0"
+	Value string
+	// Ack requests that the device acknowledge the command
+	Ack bool
+}
+
+// ControlRequest is sent to a device's control port to execute one or more commands. Unlike the
+// other requests emotivaControl has no protocol attribute, commands are the same in every version
+type ControlRequest struct {
+	Commands []Command
+}
+
+// CommandAck is the device's acknowledgement of a single command
+type CommandAck struct {
+	Tag    CommandTag
+	Status AckStatus
+}
+
+// ControlResponse is sent by a device in reply to a ControlRequest with acks requested
+type ControlResponse struct {
+	Acks []CommandAck
+}
+
+func (r ControlRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: controlRequestElement}}
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	for _, c := range r.Commands {
+		value := c.Value
+		if value == "" {
+			value = "0"
+		}
+		ack := "no"
+		if c.Ack {
+			ack = "yes"
+		}
+		err = encodeEmptyElement(e, c.Tag.String(), "value", value, "ack", ack)
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (r *ControlRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, controlRequestElement)
+	if err != nil {
+		return err
+	}
+	r.Commands = nil
+	return decodeChildren(d, func(child xml.StartElement) error {
+		tag, err := ParseCommandTag(child.Name.Local)
+		if err != nil {
+			return err
+		}
+		r.Commands = append(r.Commands, Command{
+			Tag:   tag,
+			Value: attrValue(child, "value"),
+			Ack:   attrValue(child, "ack") == "yes",
+		})
+		return d.Skip()
+	})
+}
+
+func (r ControlResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: controlResponseElement}}
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	for _, a := range r.Acks {
+		err = encodeEmptyElement(e, a.Tag.String(), "status", string(a.Status))
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (r *ControlResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, controlResponseElement)
+	if err != nil {
+		return err
+	}
+	r.Acks = nil
+	return decodeChildren(d, func(child xml.StartElement) error {
+		tag, err := ParseCommandTag(child.Name.Local)
+		if err != nil {
+			return err
+		}
+		r.Acks = append(r.Acks, CommandAck{
+			Tag:    tag,
+			Status: AckStatus(attrValue(child, "status")),
+		})
+		return d.Skip()
+	})
+}
@@ -0,0 +1,103 @@
+package v1
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestControlRequestRoundTrip(t *testing.T) {
+	for i, s := range CommandTagStrings {
+		tag := CommandTag(i)
+		for _, c := range []Command{
+			{Tag: tag, Value: "1", Ack: true},
+			{Tag: tag, Value: "-0.5", Ack: false},
+		} {
+			b, err := xml.Marshal(ControlRequest{Commands: []Command{c}})
+			if err != nil {
+				t.Fatalf("%s: marshal: %v", s, err)
+			}
+			got := ControlRequest{}
+			err = xml.Unmarshal(b, &got)
+			if err != nil {
+				t.Fatalf("%s: unmarshal %s: %v", s, b, err)
+			}
+			if len(got.Commands) != 1 || !reflect.DeepEqual(got.Commands[0], c) {
+				t.Errorf("%s: got %+v, want %+v", s, got.Commands, c)
+			}
+		}
+	}
+}
+
+func TestControlRequestEmptyValue(t *testing.T) {
+	b, err := xml.Marshal(ControlRequest{Commands: []Command{{Tag: PowerOnCommand}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<emotivaControl><power_on value="0" ack="no"></power_on></emotivaControl>`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestControlResponseRoundTrip(t *testing.T) {
+	for i, s := range CommandTagStrings {
+		tag := CommandTag(i)
+		for _, status := range []AckStatus{StatusAck, StatusNak} {
+			resp := ControlResponse{Acks: []CommandAck{{Tag: tag, Status: status}}}
+			b, err := xml.Marshal(resp)
+			if err != nil {
+				t.Fatalf("%s: marshal: %v", s, err)
+			}
+			got := ControlResponse{}
+			err = xml.Unmarshal(b, &got)
+			if err != nil {
+				t.Fatalf("%s: unmarshal %s: %v", s, b, err)
+			}
+			if !reflect.DeepEqual(got, resp) {
+				t.Errorf("%s: got %+v, want %+v", s, got, resp)
+			}
+		}
+	}
+}
+
+func TestControlResponseStatus(t *testing.T) {
+	tests := []struct {
+		packet string
+		want   []CommandAck
+	}{
+		{
+			packet: `<emotivaAck><power_on status="ack"/></emotivaAck>`,
+			want:   []CommandAck{{Tag: PowerOnCommand, Status: StatusAck}},
+		},
+		{
+			packet: `<emotivaAck><power_on status="nak"/></emotivaAck>`,
+			want:   []CommandAck{{Tag: PowerOnCommand, Status: StatusNak}},
+		},
+		{
+			packet: `<emotivaAck><volume status="ack"/><mute_on status="nak"/></emotivaAck>`,
+			want: []CommandAck{
+				{Tag: VolumeCommand, Status: StatusAck},
+				{Tag: MuteOnCommand, Status: StatusNak},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := ControlResponse{}
+		err := xml.Unmarshal([]byte(tt.packet), &got)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.packet, err)
+		}
+		if !reflect.DeepEqual(got.Acks, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.packet, got.Acks, tt.want)
+		}
+	}
+}
+
+func TestControlResponseUnknownTag(t *testing.T) {
+	got := ControlResponse{}
+	err := xml.Unmarshal([]byte(`<emotivaAck><not_a_command status="ack"/></emotivaAck>`), &got)
+	if err == nil {
+		t.Errorf("expected an error for an unknown command, got %+v", got)
+	}
+}
@@ -4,23 +4,38 @@ import (
 	"errors"
 	"git.poundadm.net/anachronism/xmcctl/pkg/apis/config"
 	"net"
+	"time"
 )
 
+// Device is a transponder, as discovered on the network or loaded from the conf file. It converts
+// to and from both forms without losing information
 type Device struct {
-	Name        string
-	Model       string
-	IP          net.IP
-	ControlAddr net.UDPAddr
-	NotifyAddr  net.UDPAddr
-	InfoAddr    net.UDPAddr
-	SetupAddr   net.TCPAddr
+	Name  string
+	Model string
+	IP    net.IP
+	// ControlVersion is the control protocol version advertised by the device, if known
+	ControlVersion string
+	ControlAddr    net.UDPAddr
+	NotifyAddr     net.UDPAddr
+	InfoAddr       net.UDPAddr
+	// SetupAddr is the TCP address of the device's setup service, if known
+	SetupAddr net.TCPAddr
+	// KeepAlive is how often the device sends keepAlive notifications to its subscribers, if it
+	// advertised it
+	KeepAlive time.Duration
+	// Interface is the name of the local interface on the same subnet as the device. It's found from
+	// the device's IP rather than from where its response arrived, so it's empty for devices reached
+	// through a router
+	Interface string
 }
 
+// NewDeviceFromSelfIdentityResponse makes a Device from a discovery response sent from addr
 func NewDeviceFromSelfIdentityResponse(addr net.IP, sir *SelfIdentityResponse) *Device {
 	d := &Device{
-		Name:  sir.Name,
-		Model: sir.Model,
-		IP:    addr,
+		Name:           sir.Name,
+		Model:          sir.Model,
+		IP:             addr,
+		ControlVersion: sir.Control.Version,
 		ControlAddr: net.UDPAddr{
 			IP:   addr,
 			Port: sir.Control.ControlPort,
@@ -37,14 +52,20 @@ func NewDeviceFromSelfIdentityResponse(addr net.IP, sir *SelfIdentityResponse) *
 			IP:   addr,
 			Port: sir.Control.SetupPortTCP,
 		},
+		KeepAlive: time.Duration(sir.Control.KeepAlive) * time.Millisecond,
 	}
 	return d
 }
 
+// NewDeviceFromRawDevice makes a Device from one stored in the conf file. Missing control and
+// notify ports default to the ones devices advertise unless configured otherwise
 func NewDeviceFromRawDevice(rd *config.RawDevice) (*Device, error) {
 	d := &Device{
-		Name:  rd.Name,
-		Model: rd.Model,
+		Name:           rd.Name,
+		Model:          rd.Model,
+		ControlVersion: rd.ControlVersion,
+		KeepAlive:      time.Duration(rd.KeepAlive) * time.Millisecond,
+		Interface:      rd.Interface,
 	}
 	ip := net.ParseIP(rd.IP)
 	if ip == nil {
@@ -55,10 +76,16 @@ func NewDeviceFromRawDevice(rd *config.RawDevice) (*Device, error) {
 		IP:   ip,
 		Port: rd.ControlPort,
 	}
+	if d.ControlAddr.Port == 0 {
+		d.ControlAddr.Port = DefaultControlPort
+	}
 	d.NotifyAddr = net.UDPAddr{
 		IP:   ip,
 		Port: rd.NotifyPort,
 	}
+	if d.NotifyAddr.Port == 0 {
+		d.NotifyAddr.Port = DefaultNotifyPort
+	}
 	d.InfoAddr = net.UDPAddr{
 		IP:   ip,
 		Port: rd.InfoPort,
@@ -69,3 +96,55 @@ func NewDeviceFromRawDevice(rd *config.RawDevice) (*Device, error) {
 	}
 	return d, nil
 }
+
+// RawDevice converts the Device into the form stored in the conf file
+func (d *Device) RawDevice() config.RawDevice {
+	return config.RawDevice{
+		Name:           d.Name,
+		Model:          d.Model,
+		IP:             d.IP.String(),
+		ControlVersion: d.ControlVersion,
+		ControlPort:    d.ControlAddr.Port,
+		NotifyPort:     d.NotifyAddr.Port,
+		InfoPort:       d.InfoAddr.Port,
+		SetupPort:      d.SetupAddr.Port,
+		KeepAlive:      int(d.KeepAlive / time.Millisecond),
+		Interface:      d.Interface,
+	}
+}
+
+// SelfIdentityResponse converts the Device into the discovery response it would send. The
+// response has no IP or interface, those come from where it was received
+func (d *Device) SelfIdentityResponse() SelfIdentityResponse {
+	sir := SelfIdentityResponse{
+		Model: d.Model,
+		Name:  d.Name,
+	}
+	sir.Control.Version = d.ControlVersion
+	sir.Control.ControlPort = d.ControlAddr.Port
+	sir.Control.NotifyPort = d.NotifyAddr.Port
+	sir.Control.InfoPort = d.InfoAddr.Port
+	sir.Control.SetupPortTCP = d.SetupAddr.Port
+	sir.Control.KeepAlive = int(d.KeepAlive / time.Millisecond)
+	return sir
+}
+
+// Protocol returns the protocol attribute to send in requests to the device, chosen by its control
+// version
+func (d *Device) Protocol() string {
+	return RequestProtocol(d.ControlVersion)
+}
+
+// Equal reports whether d and o describe the same device at the same addresses
+func (d *Device) Equal(o *Device) bool {
+	return d.Name == o.Name &&
+		d.Model == o.Model &&
+		d.IP.Equal(o.IP) &&
+		d.ControlVersion == o.ControlVersion &&
+		d.ControlAddr.String() == o.ControlAddr.String() &&
+		d.NotifyAddr.String() == o.NotifyAddr.String() &&
+		d.InfoAddr.String() == o.InfoAddr.String() &&
+		d.SetupAddr.String() == o.SetupAddr.String() &&
+		d.KeepAlive == o.KeepAlive &&
+		d.Interface == o.Interface
+}
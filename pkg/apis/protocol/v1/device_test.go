@@ -0,0 +1,73 @@
+package v1
+
+import (
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeviceRawDeviceRoundTrip(t *testing.T) {
+	rd := config.RawDevice{
+		Name:           "living",
+		Model:          "XMC-1",
+		IP:             "10.0.0.5",
+		ControlVersion: ProtocolVersion3,
+		ControlPort:    17002,
+		NotifyPort:     17003,
+		InfoPort:       7004,
+		SetupPort:      7100,
+		KeepAlive:      10000,
+		Interface:      "eth0",
+	}
+	d, err := NewDeviceFromRawDevice(&rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.KeepAlive != 10*time.Second {
+		t.Errorf("got keepAlive %v, want 10s", d.KeepAlive)
+	}
+	if got := d.RawDevice(); got != rd {
+		t.Errorf("got %+v, want %+v", got, rd)
+	}
+}
+
+func TestDeviceFromRawDeviceDefaultPorts(t *testing.T) {
+	d, err := NewDeviceFromRawDevice(&config.RawDevice{Name: "living", Model: "XMC-1", IP: "10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ControlAddr.Port != DefaultControlPort {
+		t.Errorf("got control port %d, want %d", d.ControlAddr.Port, DefaultControlPort)
+	}
+	if d.NotifyAddr.Port != DefaultNotifyPort {
+		t.Errorf("got notify port %d, want %d", d.NotifyAddr.Port, DefaultNotifyPort)
+	}
+}
+
+func TestDeviceSelfIdentityResponseRoundTrip(t *testing.T) {
+	d := &Device{
+		Name:           "living",
+		Model:          "XMC-1",
+		IP:             net.ParseIP("10.0.0.5"),
+		ControlVersion: ProtocolVersion2,
+		KeepAlive:      10 * time.Second,
+	}
+	d.ControlAddr = net.UDPAddr{IP: d.IP, Port: DefaultControlPort}
+	d.NotifyAddr = net.UDPAddr{IP: d.IP, Port: DefaultNotifyPort}
+	d.InfoAddr = net.UDPAddr{IP: d.IP, Port: 7004}
+	d.SetupAddr = net.TCPAddr{IP: d.IP, Port: 7100}
+
+	sir := d.SelfIdentityResponse()
+	got := NewDeviceFromSelfIdentityResponse(d.IP, &sir)
+	if !got.Equal(d) {
+		t.Errorf("got %+v, want %+v", got, d)
+	}
+}
+
+func TestDeviceFromRawDeviceBadIP(t *testing.T) {
+	_, err := NewDeviceFromRawDevice(&config.RawDevice{Name: "living", Model: "XMC-1", IP: "not-an-ip"})
+	if err == nil {
+		t.Error("expected an error for an unparseable IP")
+	}
+}
@@ -0,0 +1,58 @@
+package v1
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+const notifyElement = "emotivaNotify"
+
+// Notification is sent by a device to the notify port when subscribed properties change
+type Notification struct {
+	// Sequence is incremented by the device for each notification it sends
+	Sequence int
+	// Protocol is the protocol version the device sent, empty for protocol 2.0 devices
+	Protocol string
+	// Properties holds the new state of each property which changed
+	Properties []Property
+	// Unknown holds any properties in the notification which aren't known NotificationTags
+	Unknown []UnknownResponse
+}
+
+// DecodeNotification decodes an emotivaNotify packet
+func DecodeNotification(packet []byte) (*Notification, error) {
+	n := &Notification{}
+	err := xml.Unmarshal(packet, n)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n Notification) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{
+		Name: xml.Name{Local: notifyElement},
+		Attr: append(
+			[]xml.Attr{{Name: xml.Name{Local: "sequence"}, Value: strconv.Itoa(n.Sequence)}},
+			protocolAttr(n.Protocol)...,
+		),
+	}
+	return encodePropertyList(e, start, n.Protocol, n.Properties, propertyValue)
+}
+
+func (n *Notification) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, notifyElement)
+	if err != nil {
+		return err
+	}
+	n.Sequence = 0
+	if seq := attrValue(start, "sequence"); seq != "" {
+		n.Sequence, err = strconv.Atoi(seq)
+		if err != nil {
+			return err
+		}
+	}
+	n.Protocol = attrValue(start, "protocol")
+	n.Properties, n.Unknown, err = decodePropertyList(d)
+	return err
+}
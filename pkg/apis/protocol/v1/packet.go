@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+const selfIdentityResponseElement = "emotivaTransponder"
+
+// MarshalPacket encodes v as an XML document ready to be sent to a device
+func MarshalPacket(v interface{}) ([]byte, error) {
+	packet := bytes.NewBuffer([]byte{})
+	packet.Write([]byte(xml.Header))
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	packet.Write(data)
+	return packet.Bytes(), nil
+}
+
+// DecodePacket decodes any packet sent by a device, returning a pointer to the response type named by
+// its root element. Packets with a root element that isn't known are returned as an *UnknownResponse
+func DecodePacket(packet []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var v interface{}
+		switch start.Name.Local {
+		case controlResponseElement:
+			v = &ControlResponse{}
+		case notifyElement:
+			v = &Notification{}
+		case updateElement:
+			v = &UpdateResponse{}
+		case subscribeElement:
+			v = &SubscribeResponse{}
+		case unsubscribeElement:
+			v = &UnsubscribeResponse{}
+		case selfIdentityResponseElement:
+			v = &SelfIdentityResponse{}
+		default:
+			v = &UnknownResponse{}
+		}
+		err = d.DecodeElement(v, &start)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,149 @@
+package v1
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// propertyElement is the element name protocol 3.0 devices use for each property, with the tag in a
+// name attribute instead of the element name
+const propertyElement = "property"
+
+// Property is the state of a single NotificationTag as reported by a device
+type Property struct {
+	Tag   NotificationTag
+	Value string
+	// Visible reports whether the device is displaying the property, e.g. tuner properties are
+	// hidden while another source is selected
+	Visible bool
+	// Status is the device's acknowledgement of the request for this property. It's empty in
+	// notifications
+	Status AckStatus
+}
+
+// propertyFields selects which attributes are encoded for each Property
+type propertyFields int
+
+const (
+	propertyValue propertyFields = 1 << iota
+	propertyStatus
+)
+
+// usesPropertyElements reports whether a protocol version names tags with <property name=""> elements
+func usesPropertyElements(protocol string) bool {
+	v, err := strconv.ParseFloat(protocol, 64)
+	return err == nil && v >= 3
+}
+
+// RequestProtocol returns the protocol attribute to send in requests to a device advertising the
+// passed control version. Protocol 2.0 requests have none, and later versions request the newest
+// format this package understands
+func RequestProtocol(controlVersion string) string {
+	if !usesPropertyElements(controlVersion) {
+		return ""
+	}
+	return ProtocolVersion3
+}
+
+// protocolAttr returns the protocol attribute for a request or response root element
+func protocolAttr(protocol string) []xml.Attr {
+	if protocol == "" {
+		return nil
+	}
+	return []xml.Attr{{Name: xml.Name{Local: "protocol"}, Value: protocol}}
+}
+
+// encodeTagList writes start with an empty child element for each tag
+func encodeTagList(e *xml.Encoder, start xml.StartElement, tags []NotificationTag) error {
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		err = encodeEmptyElement(e, t.String())
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// decodeTagList reads the tags of each child element of the element being decoded, in either the
+// element per tag or the <property name=""> form
+func decodeTagList(d *xml.Decoder) ([]NotificationTag, error) {
+	tags := make([]NotificationTag, 0)
+	err := decodeChildren(d, func(child xml.StartElement) error {
+		tag, err := ParseNotificationTag(propertyName(child))
+		if err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+		return d.Skip()
+	})
+	return tags, err
+}
+
+// encodePropertyList writes start with a child element for each property. Properties are written as
+// <property name=""> elements if protocol calls for it
+func encodePropertyList(e *xml.Encoder, start xml.StartElement, protocol string, props []Property, fields propertyFields) error {
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	for _, p := range props {
+		name := p.Tag.String()
+		attrs := make([]string, 0, 8)
+		if usesPropertyElements(protocol) {
+			attrs = append(attrs, "name", name)
+			name = propertyElement
+		}
+		if fields&propertyValue != 0 {
+			attrs = append(attrs, "value", p.Value, "visible", strconv.FormatBool(p.Visible))
+		}
+		if fields&propertyStatus != 0 {
+			attrs = append(attrs, "status", string(p.Status))
+		}
+		err = encodeEmptyElement(e, name, attrs...)
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// decodePropertyList reads each child element of the element being decoded as a Property, in either
+// the element per tag or the <property name=""> form. Children naming tags that aren't known are
+// returned as UnknownResponses rather than failing the whole list
+func decodePropertyList(d *xml.Decoder) ([]Property, []UnknownResponse, error) {
+	props := make([]Property, 0)
+	unknown := make([]UnknownResponse, 0)
+	err := decodeChildren(d, func(child xml.StartElement) error {
+		tag, err := ParseNotificationTag(propertyName(child))
+		if err != nil {
+			u := UnknownResponse{}
+			err = d.DecodeElement(&u, &child)
+			if err != nil {
+				return err
+			}
+			unknown = append(unknown, u)
+			return nil
+		}
+		props = append(props, Property{
+			Tag:     tag,
+			Value:   attrValue(child, "value"),
+			Visible: attrValue(child, "visible") == "true",
+			Status:  AckStatus(attrValue(child, "status")),
+		})
+		return d.Skip()
+	})
+	return props, unknown, err
+}
+
+// propertyName returns the tag name of a child element in either the element per tag or the
+// <property name=""> form
+func propertyName(child xml.StartElement) string {
+	if child.Name.Local == propertyElement {
+		return attrValue(child, "name")
+	}
+	return child.Name.Local
+}
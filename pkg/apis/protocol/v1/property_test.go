@@ -0,0 +1,139 @@
+package v1
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestRequestProtocol(t *testing.T) {
+	tests := []struct {
+		controlVersion string
+		want           string
+	}{
+		{controlVersion: "", want: ""},
+		{controlVersion: "not-a-version", want: ""},
+		{controlVersion: "1.0", want: ""},
+		{controlVersion: ProtocolVersion2, want: ""},
+		{controlVersion: ProtocolVersion3, want: ProtocolVersion3},
+		{controlVersion: "3.1", want: ProtocolVersion3},
+	}
+	for _, tt := range tests {
+		if got := RequestProtocol(tt.controlVersion); got != tt.want {
+			t.Errorf("RequestProtocol(%q) = %q, want %q", tt.controlVersion, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeRequests(t *testing.T) {
+	tags := []NotificationTag{PowerNotification, VolumeNotification}
+	tests := []struct {
+		name string
+		req  interface{}
+		want string
+	}{
+		{
+			name: "subscribe 2.0",
+			req:  SubscribeRequest{Tags: tags},
+			want: `<emotivaSubscription><power></power><volume></volume></emotivaSubscription>`,
+		},
+		{
+			name: "subscribe 3.0",
+			req:  SubscribeRequest{Protocol: ProtocolVersion3, Tags: tags},
+			want: `<emotivaSubscription protocol="3.0"><power></power><volume></volume></emotivaSubscription>`,
+		},
+		{
+			name: "update 2.0",
+			req:  UpdateRequest{Tags: tags[:1]},
+			want: `<emotivaUpdate><power></power></emotivaUpdate>`,
+		},
+		{
+			name: "update 3.0",
+			req:  UpdateRequest{Protocol: ProtocolVersion3, Tags: tags[:1]},
+			want: `<emotivaUpdate protocol="3.0"><power></power></emotivaUpdate>`,
+		},
+	}
+	for _, tt := range tests {
+		b, err := xml.Marshal(tt.req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, b, tt.want)
+		}
+	}
+}
+
+func TestSubscribeResponseRoundTrip(t *testing.T) {
+	props := []Property{
+		{Tag: PowerNotification, Value: "On", Visible: true, Status: StatusAck},
+		{Tag: VolumeNotification, Value: "-30.5", Visible: true, Status: StatusAck},
+	}
+	tests := []struct {
+		protocol string
+		want     string
+	}{
+		{
+			protocol: "",
+			want:     `<emotivaSubscription><power value="On" visible="true" status="ack"></power><volume value="-30.5" visible="true" status="ack"></volume></emotivaSubscription>`,
+		},
+		{
+			protocol: ProtocolVersion3,
+			want:     `<emotivaSubscription protocol="3.0"><property name="power" value="On" visible="true" status="ack"></property><property name="volume" value="-30.5" visible="true" status="ack"></property></emotivaSubscription>`,
+		},
+	}
+	for _, tt := range tests {
+		b, err := xml.Marshal(SubscribeResponse{Protocol: tt.protocol, Properties: props})
+		if err != nil {
+			t.Fatalf("%q: marshal: %v", tt.protocol, err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.protocol, b, tt.want)
+		}
+		got := SubscribeResponse{}
+		err = xml.Unmarshal(b, &got)
+		if err != nil {
+			t.Fatalf("%q: unmarshal: %v", tt.protocol, err)
+		}
+		if got.Protocol != tt.protocol || !reflect.DeepEqual(got.Properties, props) {
+			t.Errorf("%q: got %+v, want %+v", tt.protocol, got, props)
+		}
+	}
+}
+
+func TestDecodeNotification(t *testing.T) {
+	want := []Property{
+		{Tag: PowerNotification, Value: "On", Visible: true},
+		{Tag: VolumeNotification, Value: "-30.5", Visible: true},
+	}
+	tests := []struct {
+		name     string
+		packet   string
+		protocol string
+	}{
+		{
+			name:   "2.0",
+			packet: `<?xml version="1.0"?><emotivaNotify sequence="162"><power value="On" visible="true"/><bogus value="x"/><volume value="-30.5" visible="true"/></emotivaNotify>`,
+		},
+		{
+			name:     "3.0",
+			packet:   `<?xml version="1.0"?><emotivaNotify sequence="162" protocol="3.0"><property name="power" value="On" visible="true"/><property name="bogus" value="x"/><property name="volume" value="-30.5" visible="true"/></emotivaNotify>`,
+			protocol: ProtocolVersion3,
+		},
+	}
+	for _, tt := range tests {
+		n, err := DecodeNotification([]byte(tt.packet))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if n.Sequence != 162 || n.Protocol != tt.protocol {
+			t.Errorf("%s: got sequence %d protocol %q, want 162 and %q", tt.name, n.Sequence, n.Protocol, tt.protocol)
+		}
+		if !reflect.DeepEqual(n.Properties, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, n.Properties, want)
+		}
+		if len(n.Unknown) != 1 {
+			t.Errorf("%s: got unknown %+v, want the bogus property", tt.name, n.Unknown)
+		}
+	}
+}
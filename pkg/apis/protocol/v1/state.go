@@ -0,0 +1,138 @@
+package v1
+
+import (
+	"strconv"
+	"strings"
+)
+
+// StateTags are the properties which make up a DeviceState
+var StateTags = []NotificationTag{
+	PowerNotification,
+	VolumeNotification,
+	SourceNotification,
+	ModeNotification,
+	AudioBitstreamNotification,
+	VideoFormatNotification,
+	TunerBandNotification,
+	TunerChannelNotification,
+	TunerProgramNotification,
+	TunerSignalNotification,
+	TunerRDSNotification,
+	Zone2PowerNotification,
+	Zone2VolumeNotification,
+	Zone2InputNotification,
+}
+
+// DeviceState is what a device is doing, assembled from the properties it reports
+type DeviceState struct {
+	Device
+	Power bool
+	// VolumeDB is the main zone volume in dB
+	VolumeDB       float64
+	Source         string
+	Mode           string
+	AudioBitstream string
+	VideoFormat    string
+	Tuner          TunerState
+	Zone2          Zone2State
+	// Properties holds the last reported value of every property applied to the state
+	Properties map[NotificationTag]Property
+}
+
+// TunerState is the state of a device's radio tuner
+type TunerState struct {
+	Band    string
+	Channel string
+	Program string
+	Signal  string
+	RDS     string
+	// Visible reports whether the tuner is the selected source
+	Visible bool
+}
+
+// Zone2State is the state of a device's second zone
+type Zone2State struct {
+	Power bool
+	// VolumeDB is the zone 2 volume in dB
+	VolumeDB float64
+	Input    string
+}
+
+// NewDeviceState makes an empty DeviceState for d
+func NewDeviceState(d Device) *DeviceState {
+	return &DeviceState{
+		Device:     d,
+		Properties: make(map[NotificationTag]Property),
+	}
+}
+
+// Apply updates the state with a reported property, returning whether the property changed
+func (s *DeviceState) Apply(p Property) bool {
+	if s.Properties == nil {
+		s.Properties = make(map[NotificationTag]Property)
+	}
+	if old, ok := s.Properties[p.Tag]; ok && old.Value == p.Value && old.Visible == p.Visible {
+		return false
+	}
+	s.Properties[p.Tag] = p
+
+	switch p.Tag {
+	case PowerNotification:
+		s.Power = ParseOnOff(p.Value)
+	case VolumeNotification:
+		if db, err := ParseDecibels(p.Value); err == nil {
+			s.VolumeDB = db
+		}
+	case SourceNotification:
+		s.Source = p.Value
+	case ModeNotification:
+		s.Mode = p.Value
+	case AudioBitstreamNotification:
+		s.AudioBitstream = p.Value
+	case VideoFormatNotification:
+		s.VideoFormat = p.Value
+	case TunerBandNotification:
+		s.Tuner.Band = p.Value
+		s.Tuner.Visible = p.Visible
+	case TunerChannelNotification:
+		s.Tuner.Channel = p.Value
+		s.Tuner.Visible = p.Visible
+	case TunerProgramNotification:
+		s.Tuner.Program = p.Value
+	case TunerSignalNotification:
+		s.Tuner.Signal = p.Value
+	case TunerRDSNotification:
+		s.Tuner.RDS = p.Value
+	case Zone2PowerNotification:
+		s.Zone2.Power = ParseOnOff(p.Value)
+	case Zone2VolumeNotification:
+		if db, err := ParseDecibels(p.Value); err == nil {
+			s.Zone2.VolumeDB = db
+		}
+	case Zone2InputNotification:
+		s.Zone2.Input = p.Value
+	}
+	return true
+}
+
+// Copy returns a deep copy of the state
+func (s *DeviceState) Copy() DeviceState {
+	c := *s
+	c.Properties = make(map[NotificationTag]Property, len(s.Properties))
+	for tag, p := range s.Properties {
+		c.Properties[tag] = p
+	}
+	return c
+}
+
+// ParseOnOff parses the value of on/off properties such as power
+func ParseOnOff(value string) bool {
+	return strings.EqualFold(strings.TrimSpace(value), "on")
+}
+
+// ParseDecibels parses the value of volume properties, with or without a dB suffix
+func ParseDecibels(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(value, "dB"), "db"))
+	return strconv.ParseFloat(value, 64)
+}
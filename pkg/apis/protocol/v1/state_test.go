@@ -0,0 +1,47 @@
+package v1
+
+import "testing"
+
+func TestDeviceStateApply(t *testing.T) {
+	s := NewDeviceState(Device{Name: "living"})
+	tests := []struct {
+		prop    Property
+		changed bool
+	}{
+		{prop: Property{Tag: PowerNotification, Value: "On", Visible: true}, changed: true},
+		{prop: Property{Tag: PowerNotification, Value: "On", Visible: true}, changed: false},
+		{prop: Property{Tag: VolumeNotification, Value: "-30.5 dB", Visible: true}, changed: true},
+		{prop: Property{Tag: SourceNotification, Value: "HDMI 1", Visible: true}, changed: true},
+		{prop: Property{Tag: TunerBandNotification, Value: "FM", Visible: false}, changed: true},
+		{prop: Property{Tag: TunerBandNotification, Value: "FM", Visible: true}, changed: true},
+		{prop: Property{Tag: Zone2PowerNotification, Value: "on", Visible: true}, changed: true},
+		{prop: Property{Tag: Zone2VolumeNotification, Value: "-40", Visible: true}, changed: true},
+		{prop: Property{Tag: VolumeNotification, Value: "not-a-volume", Visible: true}, changed: true},
+	}
+	for _, tt := range tests {
+		if got := s.Apply(tt.prop); got != tt.changed {
+			t.Errorf("Apply(%+v) = %v, want %v", tt.prop, got, tt.changed)
+		}
+	}
+
+	if !s.Power || s.Source != "HDMI 1" || !s.Tuner.Visible || s.Tuner.Band != "FM" {
+		t.Errorf("got state %+v", s)
+	}
+	// an unparseable volume is recorded but doesn't change the last known level
+	if s.VolumeDB != -30.5 || s.Properties[VolumeNotification].Value != "not-a-volume" {
+		t.Errorf("got volume %v and property %+v, want -30.5", s.VolumeDB, s.Properties[VolumeNotification])
+	}
+	if !s.Zone2.Power || s.Zone2.VolumeDB != -40 {
+		t.Errorf("got zone 2 %+v, want on at -40", s.Zone2)
+	}
+}
+
+func TestDeviceStateCopy(t *testing.T) {
+	s := NewDeviceState(Device{Name: "living"})
+	s.Apply(Property{Tag: PowerNotification, Value: "On"})
+	c := s.Copy()
+	s.Apply(Property{Tag: PowerNotification, Value: "Off"})
+	if !c.Power || c.Properties[PowerNotification].Value != "On" {
+		t.Errorf("copy changed with the original: %+v", c)
+	}
+}
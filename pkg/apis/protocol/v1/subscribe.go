@@ -0,0 +1,103 @@
+package v1
+
+import "encoding/xml"
+
+const (
+	subscribeElement   = "emotivaSubscription"
+	unsubscribeElement = "emotivaUnsubscribe"
+)
+
+// SubscribeRequest is sent to a device's control port to receive Notifications when any of the
+// requested properties change
+type SubscribeRequest struct {
+	// Protocol is the protocol version requested, it's left out of the packet when empty
+	Protocol string
+	Tags     []NotificationTag
+}
+
+// SubscribeResponse is sent by a device in reply to a SubscribeRequest with the current value of each
+// subscribed property
+type SubscribeResponse struct {
+	// Protocol is the protocol version the device replied with, empty for protocol 2.0 devices
+	Protocol   string
+	Properties []Property
+	// Unknown holds any properties in the response which aren't known NotificationTags
+	Unknown []UnknownResponse
+}
+
+// UnsubscribeRequest is sent to a device's control port to stop Notifications for properties
+type UnsubscribeRequest struct {
+	// Protocol is the protocol version requested, it's left out of the packet when empty
+	Protocol string
+	Tags     []NotificationTag
+}
+
+// UnsubscribeResponse is sent by a device in reply to an UnsubscribeRequest. Only the Tag and Status
+// of each Property are set
+type UnsubscribeResponse struct {
+	// Protocol is the protocol version the device replied with, empty for protocol 2.0 devices
+	Protocol   string
+	Properties []Property
+	// Unknown holds any properties in the response which aren't known NotificationTags
+	Unknown []UnknownResponse
+}
+
+func (r SubscribeRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: subscribeElement}, Attr: protocolAttr(r.Protocol)}
+	return encodeTagList(e, start, r.Tags)
+}
+
+func (r *SubscribeRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, subscribeElement)
+	if err != nil {
+		return err
+	}
+	r.Protocol = attrValue(start, "protocol")
+	r.Tags, err = decodeTagList(d)
+	return err
+}
+
+func (r SubscribeResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: subscribeElement}, Attr: protocolAttr(r.Protocol)}
+	return encodePropertyList(e, start, r.Protocol, r.Properties, propertyValue|propertyStatus)
+}
+
+func (r *SubscribeResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, subscribeElement)
+	if err != nil {
+		return err
+	}
+	r.Protocol = attrValue(start, "protocol")
+	r.Properties, r.Unknown, err = decodePropertyList(d)
+	return err
+}
+
+func (r UnsubscribeRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: unsubscribeElement}, Attr: protocolAttr(r.Protocol)}
+	return encodeTagList(e, start, r.Tags)
+}
+
+func (r *UnsubscribeRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, unsubscribeElement)
+	if err != nil {
+		return err
+	}
+	r.Protocol = attrValue(start, "protocol")
+	r.Tags, err = decodeTagList(d)
+	return err
+}
+
+func (r UnsubscribeResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: unsubscribeElement}, Attr: protocolAttr(r.Protocol)}
+	return encodePropertyList(e, start, r.Protocol, r.Properties, propertyStatus)
+}
+
+func (r *UnsubscribeResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, unsubscribeElement)
+	if err != nil {
+		return err
+	}
+	r.Protocol = attrValue(start, "protocol")
+	r.Properties, r.Unknown, err = decodePropertyList(d)
+	return err
+}
@@ -0,0 +1,166 @@
+package v1
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	commandTagsByString      = make(map[string]CommandTag, len(CommandTagStrings))
+	notificationTagsByString = make(map[string]NotificationTag, len(NotificationTagStrings))
+)
+
+func init() {
+	for i, s := range CommandTagStrings {
+		commandTagsByString[s] = CommandTag(i)
+	}
+	for i, s := range NotificationTagStrings {
+		notificationTagsByString[s] = NotificationTag(i)
+	}
+}
+
+// ParseCommandTag returns the CommandTag with the passed wire name
+func ParseCommandTag(s string) (CommandTag, error) {
+	t, ok := commandTagsByString[s]
+	if !ok {
+		return 0, errors.New("unknown command tag: " + s)
+	}
+	return t, nil
+}
+
+// ParseNotificationTag returns the NotificationTag with the passed wire name
+func ParseNotificationTag(s string) (NotificationTag, error) {
+	t, ok := notificationTagsByString[s]
+	if !ok {
+		return 0, errors.New("unknown notification tag: " + s)
+	}
+	return t, nil
+}
+
+// maxSuggestions is the most tags SuggestCommandTags returns
+const maxSuggestions = 5
+
+// SuggestCommandTags returns the wire names of the command tags closest to s, for suggesting
+// corrections to a mistyped tag. Closer matches come first, and nothing is returned if no tag is close
+func SuggestCommandTags(s string) []string {
+	type match struct {
+		tag      string
+		distance int
+	}
+	s = strings.ToLower(s)
+	// allow roughly one typo for every three characters typed
+	limit := len(s)/3 + 1
+	matches := make([]match, 0)
+	for _, tag := range CommandTagStrings {
+		d := levenshtein(s, strings.ToLower(tag))
+		if d > limit && !strings.Contains(strings.ToLower(tag), s) {
+			continue
+		}
+		matches = append(matches, match{tag: tag, distance: d})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].tag < matches[j].tag
+	})
+
+	suggestions := make([]string, 0, maxSuggestions)
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, matches[i].tag)
+	}
+	return suggestions
+}
+
+// levenshtein returns the number of single byte insertions, deletions and substitutions needed to
+// turn a into b
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// untracked marks relative commands which don't change a property the device reports
+const untracked NotificationTag = -1
+
+// relativeCommands maps each command whose effect depends on the device's current state, such as
+// volume steps and toggles, to the property reflecting the state it changes
+var relativeCommands = map[CommandTag]NotificationTag{
+	BackCommand:          BackNotification,
+	BassDownCommand:      untracked,
+	BassUpCommand:        untracked,
+	CenterCommand:        CenterNotification,
+	ChannelCommand:       TunerChannelNotification,
+	DimCommand:           DimNotification,
+	DownCommand:          untracked,
+	EnterCommand:         untracked,
+	FrequencyCommand:     TunerChannelNotification,
+	InfoCommand:          untracked,
+	InputCommand:         SourceNotification,
+	InputDownCommand:     SourceNotification,
+	InputUpCommand:       SourceNotification,
+	LeftCommand:          untracked,
+	LoudnessCommand:      LoudnessNotification,
+	MenuCommand:          untracked,
+	ModeCommand:          ModeNotification,
+	ModeDownCommand:      ModeNotification,
+	ModeUpCommand:        ModeNotification,
+	MuteCommand:          untracked,
+	RightCommand:         untracked,
+	SeekCommand:          TunerChannelNotification,
+	SpeakerPresetCommand: SpeakerPresetNotification,
+	SubwooferCommand:     SubwooferNotification,
+	SurroundCommand:      SurroundNotification,
+	TrebleDownCommand:    untracked,
+	TrebleUpCommand:      untracked,
+	UpCommand:            untracked,
+	VolumeCommand:        VolumeNotification,
+	Zone1BandCommand:     TunerBandNotification,
+	Zone2BandCommand:     untracked,
+	Zone2InputCommand:    Zone2InputNotification,
+	Zone2MuteCommand:     untracked,
+	Zone2PowerCommand:    Zone2PowerNotification,
+	Zone2VolumeCommand:   Zone2VolumeNotification,
+}
+
+// Relative reports whether the command changes the device's state relative to its current state, so
+// that sending it twice has a different effect than sending it once
+func (t CommandTag) Relative() bool {
+	_, ok := relativeCommands[t]
+	return ok
+}
+
+// Property returns the property reflecting the state changed by a relative command. ok is false for
+// absolute commands and relative commands whose effect the device doesn't report
+func (t CommandTag) Property() (tag NotificationTag, ok bool) {
+	tag, ok = relativeCommands[t]
+	if tag == untracked {
+		return 0, false
+	}
+	return tag, ok
+}
@@ -0,0 +1,53 @@
+package v1
+
+import "encoding/xml"
+
+const updateElement = "emotivaUpdate"
+
+// UpdateRequest is sent to a device's control port to request the current value of properties
+// without subscribing to them
+type UpdateRequest struct {
+	// Protocol is the protocol version requested, it's left out of the packet when empty
+	Protocol string
+	Tags     []NotificationTag
+}
+
+// UpdateResponse is sent by a device in reply to an UpdateRequest with the current value of each
+// requested property
+type UpdateResponse struct {
+	// Protocol is the protocol version the device replied with, empty for protocol 2.0 devices
+	Protocol   string
+	Properties []Property
+	// Unknown holds any properties in the response which aren't known NotificationTags
+	Unknown []UnknownResponse
+}
+
+func (r UpdateRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: updateElement}, Attr: protocolAttr(r.Protocol)}
+	return encodeTagList(e, start, r.Tags)
+}
+
+func (r *UpdateRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, updateElement)
+	if err != nil {
+		return err
+	}
+	r.Protocol = attrValue(start, "protocol")
+	r.Tags, err = decodeTagList(d)
+	return err
+}
+
+func (r UpdateResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: updateElement}, Attr: protocolAttr(r.Protocol)}
+	return encodePropertyList(e, start, r.Protocol, r.Properties, propertyValue|propertyStatus)
+}
+
+func (r *UpdateResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := checkElement(start, updateElement)
+	if err != nil {
+		return err
+	}
+	r.Protocol = attrValue(start, "protocol")
+	r.Properties, r.Unknown, err = decodePropertyList(d)
+	return err
+}
@@ -1,10 +1,24 @@
 package v1
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"fmt"
+)
 
 const (
 	SelfIdentityRequestPort  = 7000
 	SelfIdentityResponsePort = 7001
+	// DefaultControlPort is the control port devices advertise unless configured otherwise, replies to
+	// control packets are sent to the same port on the sender's host
+	DefaultControlPort = 7002
+	// DefaultNotifyPort is the notify port devices advertise unless configured otherwise,
+	// notifications are sent to the same port on the subscriber's host
+	DefaultNotifyPort = 7003
+)
+
+const (
+	ProtocolVersion2 = "2.0"
+	ProtocolVersion3 = "3.0"
 )
 
 type NotificationTag int
@@ -19,8 +33,20 @@ func (t CommandTag) String() string {
 	return CommandTagStrings[t]
 }
 
+// AckStatus is the status a device reports for each element of a request
+type AckStatus string
+
+const (
+	StatusAck AckStatus = "ack"
+	StatusNak AckStatus = "nak"
+)
+
 type SelfIdentityRequest struct {
 	XMLName xml.Name `xml:"emotivaPing"`
+	// Protocol is the highest protocol version the sender supports. Devices which support it
+	// advertise it as their control version, and devices which don't advertise their own highest
+	// version. Without it devices advertise protocol 2.0
+	Protocol string `xml:"protocol,attr,omitempty"`
 }
 
 type SelfIdentityResponse struct {
@@ -37,27 +63,64 @@ type SelfIdentityReponseControl struct {
 	NotifyPort   int      `xml:"notifyPort"`
 	InfoPort     int      `xml:"infoPort"`
 	SetupPortTCP int      `xml:"setupPortTCP"`
+	// KeepAlive is how often the device sends keepAlive notifications to its subscribers, in
+	// milliseconds
+	KeepAlive int `xml:"keepAlive"`
 }
 
-type ControlRequest struct{}
-
-type ControlResponse struct{}
-
-type Notification struct{}
-
-type SubscribeRequest struct{}
-
-type SubscribeResponse struct{}
-
-type UnsubscribeRequest struct{}
+type UnknownResponse struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	InnerXML []byte     `xml:",innerxml"`
+}
 
-type UnsubscribeResponse struct{}
+// checkElement returns an error if the passed element isn't named name
+func checkElement(start xml.StartElement, name string) error {
+	if start.Name.Local != name {
+		return fmt.Errorf("expected <%s> element, got <%s>", name, start.Name.Local)
+	}
+	return nil
+}
 
-type UpdateRequest struct{}
+// attrValue returns the value of the named attribute of an element, or an empty string if it's not present
+func attrValue(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
 
-type UpdateResponse struct{}
+// encodeEmptyElement writes an element with no children, attrs are alternating names and values
+func encodeEmptyElement(e *xml.Encoder, name string, attrs ...string) error {
+	el := xml.StartElement{Name: xml.Name{Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		el.Attr = append(el.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	err := e.EncodeToken(el)
+	if err != nil {
+		return err
+	}
+	return e.EncodeToken(el.End())
+}
 
-type UnknownResponse struct {
-	XMLName  xml.Name
-	InnerXML []byte `xml:",innerxml"`
+// decodeChildren calls fn for each child element of the element currently being decoded. fn is
+// responsible for consuming the child, e.g. with d.Skip()
+func decodeChildren(d *xml.Decoder, fn func(child xml.StartElement) error) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			err = fn(t)
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
 }
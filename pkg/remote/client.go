@@ -0,0 +1,380 @@
+package remote
+
+import (
+	"context"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// maxPacketSize is the largest packet expected from a device
+	maxPacketSize = 8192
+	// pollInterval bounds how long a read blocks before ctx is checked again
+	pollInterval = 100 * time.Millisecond
+)
+
+// NewRemoteFromDevice makes a Remote for a device loaded from the conf file or discovered
+func NewRemoteFromDevice(d *protov1.Device) *Remote {
+	return &Remote{
+		Device: *d,
+		Retry:  DefaultRetryPolicy,
+	}
+}
+
+// Send sends a single command to the device and waits for it to be acknowledged
+func (r *Remote) Send(ctx context.Context, cmd protov1.CommandTag, value string) error {
+	_, err := r.SendBatch(ctx, []protov1.Command{{Tag: cmd, Value: value, Ack: true}})
+	return err
+}
+
+// SendBatch sends commands to the device in a single packet and waits for each command with Ack set
+// to be acknowledged. If no commands request an ack, SendBatch returns as soon as the packet is sent
+// with a nil response.
+//
+// Unacknowledged commands are resent according to r.Retry. Relative commands, like volume steps, are
+// only resent once the property they change is confirmed unchanged, since a lost ack doesn't mean the
+// command wasn't applied. Relative commands which don't change a reported property are never resent.
+//
+// A *NakError is returned if the device refuses any commands, and a *TimeoutError if commands are still
+// unacknowledged once every attempt is used or ctx expires.
+func (r *Remote) SendBatch(ctx context.Context, cmds []protov1.Command) (*protov1.ControlResponse, error) {
+	s, err := r.openSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	pending := make(map[protov1.CommandTag]int)
+	tracked := make([]protov1.NotificationTag, 0)
+	for _, c := range cmds {
+		if !c.Ack {
+			continue
+		}
+		pending[c.Tag]++
+		if prop, ok := c.Tag.Property(); ok {
+			tracked = append(tracked, prop)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, s.send(protov1.ControlRequest{Commands: cmds})
+	}
+
+	resp := &protov1.ControlResponse{}
+	naks := make([]protov1.CommandTag, 0)
+	ack := func(a protov1.CommandAck) {
+		// acks for commands which were already acknowledged are duplicates from an earlier attempt
+		if pending[a.Tag] == 0 {
+			return
+		}
+		pending[a.Tag]--
+		if pending[a.Tag] == 0 {
+			delete(pending, a.Tag)
+		}
+		resp.Acks = append(resp.Acks, a)
+		if a.Status != protov1.StatusAck {
+			naks = append(naks, a.Tag)
+		}
+	}
+	handle := func(v interface{}) bool {
+		if cr, ok := v.(*protov1.ControlResponse); ok {
+			for _, a := range cr.Acks {
+				ack(a)
+			}
+		}
+		return len(pending) == 0
+	}
+
+	// record the state relative commands will change so a lost ack can be told apart from a lost command
+	var before map[protov1.NotificationTag]string
+	if len(tracked) > 0 && r.Retry.attempts() > 1 {
+		before, err = s.properties(ctx, tracked, handle)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"remote": r.Name,
+				"err":    err,
+			}).Warn("unable to read device state, relative commands won't be resent")
+		}
+	}
+
+	outstanding := cmds
+	for attempt := 1; ; attempt++ {
+		if len(outstanding) > 0 {
+			err = s.send(protov1.ControlRequest{Commands: outstanding})
+			if err != nil {
+				return nil, err
+			}
+		}
+		finished, err := s.receive(ctx, time.Now().Add(r.Retry.backoff(attempt)), handle)
+		if err != nil {
+			return resp, withPending(err, pending)
+		}
+		if finished {
+			break
+		}
+		if attempt >= r.Retry.attempts() {
+			return resp, withPending(&TimeoutError{}, pending)
+		}
+
+		outstanding, err = s.resendable(ctx, cmds, pending, before, handle, ack)
+		if err != nil {
+			return resp, withPending(err, pending)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		// if nothing left can safely be resent, the remaining attempts just wait for late acks
+	}
+
+	if len(naks) > 0 {
+		return resp, &NakError{Commands: naks}
+	}
+	return resp, nil
+}
+
+// Update requests the current value of each of the passed properties from the device
+func (r *Remote) Update(ctx context.Context, tags ...protov1.NotificationTag) (*protov1.UpdateResponse, error) {
+	s, err := r.openSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	return s.update(ctx, tags, nil)
+}
+
+// session holds the control port open across the packets of an exchange with a device.
+//
+// Devices send replies to the same port number on the sender's host as their own control port, so
+// that port is bound for the duration of the session.
+type session struct {
+	r    *Remote
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func (r *Remote) openSession() (*session, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: r.BindIP, Port: r.ControlAddr.Port})
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		r:    r,
+		conn: conn,
+		buf:  make([]byte, maxPacketSize),
+	}, nil
+}
+
+func (s *session) close() error {
+	return s.conn.Close()
+}
+
+// send writes req to the device's control port
+func (s *session) send(req interface{}) error {
+	packet, err := protov1.MarshalPacket(req)
+	if err != nil {
+		return err
+	}
+	nbytes, err := s.conn.WriteToUDP(packet, &s.r.ControlAddr)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"addr":   s.r.ControlAddr.String(),
+		"nbytes": nbytes,
+		"data":   string(packet),
+	}).Debug("sent control packet")
+	return nil
+}
+
+// receive decodes each packet the device sends and passes it to handle until handle reports that the
+// exchange is finished or deadline passes. Packets which can't be decoded end the exchange with a
+// *MalformedResponseError, and a *TimeoutError is returned if ctx expires first.
+func (s *session) receive(ctx context.Context, deadline time.Time, handle func(v interface{}) bool) (bool, error) {
+	for {
+		if ctx.Err() == context.DeadlineExceeded {
+			return false, &TimeoutError{}
+		} else if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			return false, nil
+		}
+
+		// reads are bounded so that ctx is checked regularly
+		readDeadline := deadline
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(readDeadline) {
+			readDeadline = ctxDeadline
+		}
+		if now.Add(pollInterval).Before(readDeadline) {
+			readDeadline = now.Add(pollInterval)
+		}
+		err := s.conn.SetReadDeadline(readDeadline)
+		if err != nil {
+			return false, err
+		}
+
+		n, raddr, err := s.conn.ReadFromUDP(s.buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return false, err
+		}
+		if !raddr.IP.Equal(s.r.ControlAddr.IP) {
+			log.WithFields(log.Fields{
+				"addr": raddr,
+			}).Debug("ignoring packet from unexpected address")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"addr": raddr,
+			"body": string(s.buf[:n]),
+		}).Debug("got packet on control port")
+
+		v, err := protov1.DecodePacket(s.buf[:n])
+		if err != nil {
+			return false, &MalformedResponseError{
+				Packet: append([]byte(nil), s.buf[:n]...),
+				Err:    err,
+			}
+		}
+		if handle(v) {
+			return true, nil
+		}
+	}
+}
+
+// exchange sends req and waits for handle to report the exchange finished, resending req according to
+// the Remote's RetryPolicy. req must be safe to apply more than once.
+func (s *session) exchange(ctx context.Context, req interface{}, handle func(v interface{}) bool) error {
+	for attempt := 1; ; attempt++ {
+		err := s.send(req)
+		if err != nil {
+			return err
+		}
+		finished, err := s.receive(ctx, time.Now().Add(s.r.Retry.backoff(attempt)), handle)
+		if err != nil || finished {
+			return err
+		}
+		if attempt >= s.r.Retry.attempts() {
+			return &TimeoutError{}
+		}
+		log.WithFields(log.Fields{
+			"remote":  s.r.Name,
+			"attempt": attempt,
+		}).Debug("no reply from device, resending")
+	}
+}
+
+// update requests the current value of tags. Any other packets received while waiting are passed to
+// other, if it's set
+func (s *session) update(ctx context.Context, tags []protov1.NotificationTag, other func(v interface{}) bool) (*protov1.UpdateResponse, error) {
+	var resp *protov1.UpdateResponse
+	err := s.exchange(ctx, protov1.UpdateRequest{Protocol: s.r.Protocol(), Tags: tags}, func(v interface{}) bool {
+		if ur, ok := v.(*protov1.UpdateResponse); ok {
+			resp = ur
+			return true
+		}
+		if other != nil {
+			other(v)
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// properties returns the current value of each of tags
+func (s *session) properties(ctx context.Context, tags []protov1.NotificationTag, other func(v interface{}) bool) (map[protov1.NotificationTag]string, error) {
+	resp, err := s.update(ctx, tags, other)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[protov1.NotificationTag]string, len(resp.Properties))
+	for _, p := range resp.Properties {
+		values[p.Tag] = p.Value
+	}
+	return values, nil
+}
+
+// resendable returns the commands from cmds which are still pending and safe to send again. Pending
+// relative commands whose property no longer matches before were applied despite their ack being lost,
+// so they're acknowledged with ack instead of being resent.
+func (s *session) resendable(
+	ctx context.Context,
+	cmds []protov1.Command,
+	pending map[protov1.CommandTag]int,
+	before map[protov1.NotificationTag]string,
+	handle func(v interface{}) bool,
+	ack func(a protov1.CommandAck),
+) ([]protov1.Command, error) {
+	var after map[protov1.NotificationTag]string
+	if before != nil {
+		tags := make([]protov1.NotificationTag, 0)
+		for _, c := range cmds {
+			if prop, ok := c.Tag.Property(); ok && pending[c.Tag] > 0 {
+				tags = append(tags, prop)
+			}
+		}
+		if len(tags) > 0 {
+			var err error
+			after, err = s.properties(ctx, tags, handle)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	resend := make([]protov1.Command, 0, len(cmds))
+	for _, c := range cmds {
+		if !c.Ack || pending[c.Tag] == 0 {
+			continue
+		}
+		if !c.Tag.Relative() {
+			resend = append(resend, c)
+			continue
+		}
+
+		prop, ok := c.Tag.Property()
+		if !ok || after == nil {
+			log.WithFields(log.Fields{
+				"remote":  s.r.Name,
+				"command": c.Tag.String(),
+			}).Debug("not resending relative command which can't be verified")
+			continue
+		}
+		if before[prop] != after[prop] {
+			log.WithFields(log.Fields{
+				"remote":   s.r.Name,
+				"command":  c.Tag.String(),
+				"property": prop.String(),
+				"before":   before[prop],
+				"after":    after[prop],
+			}).Debug("relative command was applied but its ack was lost")
+			for pending[c.Tag] > 0 {
+				ack(protov1.CommandAck{Tag: c.Tag, Status: protov1.StatusAck})
+			}
+			continue
+		}
+		resend = append(resend, c)
+	}
+	return resend, nil
+}
+
+// withPending adds the commands still pending to a *TimeoutError
+func withPending(err error, pending map[protov1.CommandTag]int) error {
+	terr, ok := err.(*TimeoutError)
+	if !ok {
+		return err
+	}
+	for tag := range pending {
+		terr.Pending = append(terr.Pending, tag)
+	}
+	sort.Slice(terr.Pending, func(i, j int) bool { return terr.Pending[i] < terr.Pending[j] })
+	return terr
+}
@@ -0,0 +1,163 @@
+package remote
+
+import (
+	"context"
+	"encoding/xml"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevice answers control and update requests like a device, applying volume steps to its state.
+// It can be made to lose requests and acks to exercise the client's retries
+type fakeDevice struct {
+	conn *net.UDPConn
+
+	mu sync.Mutex
+	// volume is the device's volume, changed by each volume command it applies
+	volume int
+	// applied counts the volume commands applied
+	applied int
+	// dropRequests is how many of the next control requests are lost before reaching the device
+	dropRequests int
+	// dropAcks is how many of the next acks are lost after the device applies the request
+	dropAcks int
+}
+
+// newFakeDevice starts a fakeDevice on 127.0.0.2 which loses the passed number of requests and acks,
+// and returns it with a Remote for it which receives replies on 127.0.0.1
+func newFakeDevice(t *testing.T, dropRequests int, dropAcks int) (*fakeDevice, *Remote) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("unable to listen on 127.0.0.2: %v", err)
+	}
+	f := &fakeDevice{conn: conn, volume: -30, dropRequests: dropRequests, dropAcks: dropAcks}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	addr := *conn.LocalAddr().(*net.UDPAddr)
+	r := NewRemoteFromDevice(&protov1.Device{
+		Name:        "fake",
+		Model:       "XMC-1",
+		IP:          addr.IP,
+		ControlAddr: addr,
+	})
+	r.BindIP = net.IPv4(127, 0, 0, 1)
+	r.Retry.Backoff = 50 * time.Millisecond
+	return f, r
+}
+
+func (f *fakeDevice) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, raddr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		reply := f.handle(buf[:n])
+		if reply == nil {
+			continue
+		}
+		packet, err := protov1.MarshalPacket(reply)
+		if err != nil {
+			return
+		}
+		f.conn.WriteToUDP(packet, raddr)
+	}
+}
+
+// handle applies a request and returns the reply to send, if any
+func (f *fakeDevice) handle(packet []byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	update := protov1.UpdateRequest{}
+	if xml.Unmarshal(packet, &update) == nil {
+		resp := protov1.UpdateResponse{}
+		for _, tag := range update.Tags {
+			prop := protov1.Property{Tag: tag, Status: protov1.StatusAck, Visible: true}
+			if tag == protov1.VolumeNotification {
+				prop.Value = strconv.Itoa(f.volume)
+			}
+			resp.Properties = append(resp.Properties, prop)
+		}
+		return resp
+	}
+
+	control := protov1.ControlRequest{}
+	if xml.Unmarshal(packet, &control) != nil {
+		return nil
+	}
+	if f.dropRequests > 0 {
+		f.dropRequests--
+		return nil
+	}
+	resp := protov1.ControlResponse{}
+	for _, c := range control.Commands {
+		if c.Tag == protov1.VolumeCommand {
+			step, _ := strconv.Atoi(c.Value)
+			f.volume += step
+			f.applied++
+		}
+		if c.Ack {
+			resp.Acks = append(resp.Acks, protov1.CommandAck{Tag: c.Tag, Status: protov1.StatusAck})
+		}
+	}
+	if f.dropAcks > 0 {
+		f.dropAcks--
+		return nil
+	}
+	return resp
+}
+
+func TestSendBatchRelativeCommandLoss(t *testing.T) {
+	tests := []struct {
+		name         string
+		dropRequests int
+		dropAcks     int
+	}{
+		{name: "delivered"},
+		{name: "dropped ack", dropAcks: 1},
+		{name: "dropped request", dropRequests: 1},
+		{name: "dropped request and ack", dropRequests: 1, dropAcks: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := newFakeDevice(t, tt.dropRequests, tt.dropAcks)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			resp, err := r.SendBatch(ctx, []protov1.Command{{Tag: protov1.VolumeCommand, Value: "1", Ack: true}})
+			if err != nil {
+				t.Fatalf("SendBatch: %v", err)
+			}
+			if len(resp.Acks) != 1 || resp.Acks[0].Status != protov1.StatusAck {
+				t.Errorf("got acks %+v, want one ack", resp.Acks)
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.applied != 1 || f.volume != -29 {
+				t.Errorf("volume step applied %d times, volume %d, want once and -29", f.applied, f.volume)
+			}
+		})
+	}
+}
+
+func TestSendBatchTimeout(t *testing.T) {
+	_, r := newFakeDevice(t, DefaultRetryPolicy.attempts(), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.SendBatch(ctx, []protov1.Command{{Tag: protov1.PowerOnCommand, Ack: true}})
+	terr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("got %v, want a *TimeoutError", err)
+	}
+	if len(terr.Pending) != 1 || terr.Pending[0] != protov1.PowerOnCommand {
+		t.Errorf("got pending %v, want power_on", terr.Pending)
+	}
+}
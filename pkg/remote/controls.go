@@ -0,0 +1,236 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinVolumeDB is the lowest volume a device can be set to
+	MinVolumeDB = -96.0
+	// MaxVolumeDB is the highest volume a device can be set to
+	MaxVolumeDB = 11.0
+)
+
+// mainInputCommands maps normalized names of the main zone's inputs to the command which selects them
+var mainInputCommands = map[string]protov1.CommandTag{
+	"analog1":   protov1.Analog1Command,
+	"analog2":   protov1.Analog2Command,
+	"analog3":   protov1.Analog3Command,
+	"analog4":   protov1.Analog4Command,
+	"analog5":   protov1.Analog5Command,
+	"analog71":  protov1.Analog71Command,
+	"arc":       protov1.ARCCommand,
+	"coax1":     protov1.Coax1Command,
+	"coax2":     protov1.Coax2Command,
+	"coax3":     protov1.Coax3Command,
+	"coax4":     protov1.Coax4Command,
+	"frontin":   protov1.FrontInCommand,
+	"hdmi1":     protov1.Hdmi1Command,
+	"hdmi2":     protov1.Hdmi2Command,
+	"hdmi3":     protov1.Hdmi3Command,
+	"hdmi4":     protov1.Hdmi4Command,
+	"hdmi5":     protov1.Hdmi5Command,
+	"hdmi6":     protov1.Hdmi6Command,
+	"hdmi7":     protov1.Hdmi7Command,
+	"hdmi8":     protov1.Hdmi8Command,
+	"optical1":  protov1.Optical1Command,
+	"optical2":  protov1.Optical2Command,
+	"optical3":  protov1.Optical3Command,
+	"optical4":  protov1.Optical4Command,
+	"source1":   protov1.Source1Command,
+	"source2":   protov1.Source2Command,
+	"source3":   protov1.Source3Command,
+	"source4":   protov1.Source4Command,
+	"source5":   protov1.Source5Command,
+	"source6":   protov1.Source6Command,
+	"source7":   protov1.Source7Command,
+	"source8":   protov1.Source8Command,
+	"tuner":     protov1.SourceTunerCommand,
+	"usb":       protov1.USBStreamCommand,
+	"usbstream": protov1.USBStreamCommand,
+}
+
+// zone2InputCommands maps normalized names of zone 2's inputs to the command which selects them
+var zone2InputCommands = map[string]protov1.CommandTag{
+	"analog1":    protov1.Zone2Analog1Command,
+	"analog2":    protov1.Zone2Analog2Command,
+	"analog3":    protov1.Zone2Analog3Command,
+	"analog4":    protov1.Zone2Analog4Command,
+	"analog5":    protov1.Zone2Analog5Command,
+	"analog71":   protov1.Zone2Analog71Command,
+	"analog8":    protov1.Zone2Analog8Command,
+	"arc":        protov1.Zone2ARCCommand,
+	"coax1":      protov1.Zone2Coax1Command,
+	"coax2":      protov1.Zone2Coax2Command,
+	"coax3":      protov1.Zone2Coax3Command,
+	"coax4":      protov1.Zone2Coax4Command,
+	"ethernet":   protov1.Zone2EthernetCommand,
+	"followmain": protov1.Zone2FollowMainCommand,
+	"frontin":    protov1.Zone2FrontInCommand,
+	"main":       protov1.Zone2FollowMainCommand,
+	"optical1":   protov1.Zone2Optical1Command,
+	"optical2":   protov1.Zone2Optical2Command,
+	"optical3":   protov1.Zone2Optical3Command,
+	"optical4":   protov1.Zone2Optical4Command,
+}
+
+// sourceLabels are the properties holding the user assigned name of each source, in the same order
+// as sourceCommands
+var sourceLabels = []protov1.NotificationTag{
+	protov1.Input1Notification,
+	protov1.Input2Notification,
+	protov1.Input3Notification,
+	protov1.Input4Notification,
+	protov1.Input5Notification,
+	protov1.Input6Notification,
+	protov1.Input7Notification,
+	protov1.Input8Notification,
+}
+
+// sourceCommands select each of the sources named by sourceLabels
+var sourceCommands = []protov1.CommandTag{
+	protov1.Source1Command,
+	protov1.Source2Command,
+	protov1.Source3Command,
+	protov1.Source4Command,
+	protov1.Source5Command,
+	protov1.Source6Command,
+	protov1.Source7Command,
+	protov1.Source8Command,
+}
+
+// modeCommands maps normalized surround mode names to the command which selects them
+var modeCommands = map[string]protov1.CommandTag{
+	"allstereo":       protov1.AllStereoCommand,
+	"auto":            protov1.AutoCommand,
+	"direct":          protov1.DirectCommand,
+	"dolby":           protov1.DolbyCommand,
+	"dts":             protov1.DTSCommand,
+	"movie":           protov1.MovieCommand,
+	"music":           protov1.MusicCommand,
+	"referencestereo": protov1.ReferenceStereoCommand,
+	"refstereo":       protov1.ReferenceStereoCommand,
+}
+
+// Power turns the zone on or off
+func (z *Zone) Power(ctx context.Context, on bool) error {
+	if on {
+		return z.remote.Send(ctx, z.tags.powerOn, "")
+	}
+	return z.remote.Send(ctx, z.tags.powerOff, "")
+}
+
+// TogglePower turns the zone off if it's on and on if it's off, returning whether it's now on
+func (z *Zone) TogglePower(ctx context.Context) (bool, error) {
+	on, err := z.remote.onOff(ctx, z.tags.powerProperty)
+	if err != nil {
+		return false, err
+	}
+	return !on, z.Power(ctx, !on)
+}
+
+// SetVolume sets the zone's volume to db, which must be between MinVolumeDB and MaxVolumeDB
+func (z *Zone) SetVolume(ctx context.Context, db float64) error {
+	if db < MinVolumeDB || db > MaxVolumeDB {
+		return fmt.Errorf("volume must be between %gdB and %gdB: %gdB", MinVolumeDB, MaxVolumeDB, db)
+	}
+	return z.remote.Send(ctx, z.tags.setVolume, formatDecibels(db))
+}
+
+// StepVolume raises or lowers the zone's volume by db
+func (z *Zone) StepVolume(ctx context.Context, db float64) error {
+	return z.remote.Send(ctx, z.tags.volume, formatDecibels(db))
+}
+
+// Mute mutes or unmutes the zone
+func (z *Zone) Mute(ctx context.Context, on bool) error {
+	if on {
+		return z.remote.Send(ctx, z.tags.muteOn, "")
+	}
+	return z.remote.Send(ctx, z.tags.muteOff, "")
+}
+
+// ToggleMute mutes the zone if it's unmuted and unmutes it otherwise. Devices don't report whether
+// they're muted, so the device toggles it itself
+func (z *Zone) ToggleMute(ctx context.Context) error {
+	return z.remote.Send(ctx, z.tags.mute, "")
+}
+
+// SetInput selects the input named name, which is either an input like hdmi3 or coax1, or for the
+// main zone the label assigned to one of the device's sources such as "Apple TV". Case, spaces,
+// dashes and underscores are ignored when matching names
+func (z *Zone) SetInput(ctx context.Context, name string) error {
+	if cmd, ok := z.tags.inputs[normalizeName(name)]; ok {
+		return z.remote.Send(ctx, cmd, "")
+	}
+	if z.ID != MainZone {
+		return errors.New("no " + z.ID.String() + " input named " + name)
+	}
+
+	resp, err := z.remote.Update(ctx, sourceLabels...)
+	if err != nil {
+		return err
+	}
+	for _, p := range resp.Properties {
+		for i, tag := range sourceLabels {
+			if p.Tag == tag && normalizeName(p.Value) == normalizeName(name) {
+				return z.remote.Send(ctx, sourceCommands[i], "")
+			}
+		}
+	}
+	return errors.New("no input named " + name)
+}
+
+// SetMode selects the surround mode of the main zone named name, such as movie, dolby or direct
+func (r *Remote) SetMode(ctx context.Context, name string) error {
+	cmd, ok := modeCommands[normalizeName(name)]
+	if !ok {
+		return errors.New("no mode named " + name)
+	}
+	return r.Send(ctx, cmd, "")
+}
+
+// VolumeFromPercent converts a percentage of the device's volume range to dB, rounded to the nearest
+// half dB
+func VolumeFromPercent(percent float64) (float64, error) {
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("volume percentage must be between 0 and 100: %g", percent)
+	}
+	db := MinVolumeDB + (MaxVolumeDB-MinVolumeDB)*percent/100
+	return math.Round(db*2) / 2, nil
+}
+
+// onOff reads the current value of an on/off property such as power
+func (r *Remote) onOff(ctx context.Context, tag protov1.NotificationTag) (bool, error) {
+	resp, err := r.Update(ctx, tag)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range resp.Properties {
+		if p.Tag == tag {
+			return protov1.ParseOnOff(p.Value), nil
+		}
+	}
+	return false, errors.New("device didn't report " + tag.String())
+}
+
+func formatDecibels(db float64) string {
+	return strconv.FormatFloat(db, 'f', -1, 64)
+}
+
+// normalizeName lower cases name and strips the characters which vary between ways of writing it
+func normalizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '_', '.':
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(name)))
+}
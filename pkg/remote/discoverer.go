@@ -0,0 +1,265 @@
+package remote
+
+import (
+	"context"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultDiscoveryInterval is how often a Discoverer sweeps for devices unless it's set otherwise
+	DefaultDiscoveryInterval = 30 * time.Second
+	// DefaultSweepTimeout is how long a Discoverer waits for responses to each sweep
+	DefaultSweepTimeout = 3 * time.Second
+	// DefaultMissedKeepAlives is how many keepAlive periods a device can go unseen before it's
+	// considered removed
+	DefaultMissedKeepAlives = 3
+)
+
+// DiscoveryEventType is the kind of change a DiscoveryEvent reports
+type DiscoveryEventType int
+
+const (
+	// DeviceAdded is emitted the first time a device responds
+	DeviceAdded DiscoveryEventType = iota
+	// DeviceUpdated is emitted when a known device responds with a different address, ports or
+	// protocol version
+	DeviceUpdated
+	// DeviceRemoved is emitted once a device has stopped responding
+	DeviceRemoved
+)
+
+func (t DiscoveryEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceUpdated:
+		return "updated"
+	case DeviceRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// DiscoveryEvent reports a device joining, changing or leaving the network
+type DiscoveryEvent struct {
+	Type DiscoveryEventType
+	// Device is the device as it last responded
+	Device *protov1.Device
+}
+
+// Discoverer sweeps for devices periodically, following them as they join and leave the network.
+// Between sweeps, known devices are probed directly once every keepAlive period they advertised, so
+// devices which go offline are noticed after MissedKeepAlives of those periods. Devices are
+// identified by their IP, so devices sharing a default name are kept apart, but a device which stops
+// answering on its IP while one with the same model and name appears elsewhere is reported as
+// updated rather than removed and added again
+type Discoverer struct {
+	// Bind is the local address to listen for responses on
+	Bind net.IP
+	// Dests are the addresses discovery packets are sent to
+	Dests []net.IP
+	// Interval is how often to sweep for devices
+	Interval time.Duration
+	// SweepTimeout is how long to wait for responses once each sweep's packets are sent. Sweeps
+	// should finish within Interval
+	SweepTimeout time.Duration
+	// MissedKeepAlives is how many of a device's keepAlive periods, or sweep intervals if it didn't
+	// advertise a keepAlive, can pass without a response before it's removed
+	MissedKeepAlives int
+	// Options limits how quickly discovery packets are sent during each sweep
+	Options DiscoveryOptions
+
+	events chan DiscoveryEvent
+	// known is a mapping of IPs, in string form, to the devices found there
+	known map[string]*discovered
+}
+
+// discovered is a device found by a Discoverer
+type discovered struct {
+	device   *protov1.Device
+	lastSeen time.Time
+}
+
+// NewDiscoverer makes a Discoverer sending to dests with the default intervals
+func NewDiscoverer(bind net.IP, dests []net.IP) *Discoverer {
+	return &Discoverer{
+		Bind:             bind,
+		Dests:            dests,
+		Interval:         DefaultDiscoveryInterval,
+		SweepTimeout:     DefaultSweepTimeout,
+		MissedKeepAlives: DefaultMissedKeepAlives,
+		events:           make(chan DiscoveryEvent),
+		known:            make(map[string]*discovered),
+	}
+}
+
+// Events returns the channel receiving each change found by Run. It's closed when Run returns
+func (d *Discoverer) Events() <-chan DiscoveryEvent {
+	return d.events
+}
+
+// Run sweeps for devices every Interval, probing known devices in between, until ctx is closed.
+// Sweeps which fail, e.g. during a brief network outage, are logged and skipped
+func (d *Discoverer) Run(ctx context.Context) error {
+	defer close(d.events)
+	var lastSweep time.Time
+	for {
+		dests := d.Dests
+		if time.Since(lastSweep) >= d.Interval {
+			lastSweep = time.Now()
+		} else {
+			dests = d.knownIPs()
+		}
+		if len(dests) > 0 {
+			err := d.sweep(ctx, dests)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warn("discovery sweep failed")
+			}
+		}
+
+		timer := time.NewTimer(d.nextSweep(lastSweep))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// nextSweep returns how long to wait before the next sweep, or before probing the known devices if
+// one of their keepAlive periods will pass first
+func (d *Discoverer) nextSweep(lastSweep time.Time) time.Duration {
+	wait := time.Until(lastSweep.Add(d.Interval))
+	for _, known := range d.known {
+		// a probe takes SweepTimeout, so it's started that long before the period ends
+		probe := known.device.KeepAlive - d.SweepTimeout
+		if known.device.KeepAlive > 0 && probe < wait {
+			wait = probe
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// knownIPs returns the address of each known device
+func (d *Discoverer) knownIPs() []net.IP {
+	ips := make([]net.IP, 0, len(d.known))
+	for _, known := range d.known {
+		ips = append(ips, known.device.IP)
+	}
+	return ips
+}
+
+// sweep discovers the devices at dests which respond within SweepTimeout and emits events for any
+// changes
+func (d *Discoverer) sweep(ctx context.Context, dests []net.IP) error {
+	sweepCtx, cancel := context.WithTimeout(ctx, d.Options.SendDuration(len(dests))+d.SweepTimeout)
+	defer cancel()
+	devices, err := DiscoverTranspondersWithOptions(sweepCtx, d.Bind, dests, d.Options)
+	if err != nil {
+		return err
+	}
+	// the sweep was cut short, so devices which didn't respond may not have had the chance
+	if ctx.Err() != nil {
+		return nil
+	}
+	d.update(ctx, devices, time.Now())
+	return nil
+}
+
+// update records the devices which responded at now and emits events for any changes, including
+// known devices which have now gone too long without responding
+func (d *Discoverer) update(ctx context.Context, devices []*protov1.Device, now time.Time) {
+	responded := make(map[string]bool, len(devices))
+	for _, dev := range devices {
+		responded[dev.IP.String()] = true
+	}
+	for _, dev := range devices {
+		key := dev.IP.String()
+		known, ok := d.known[key]
+		if !ok {
+			known, ok = d.moved(dev, responded)
+			if ok {
+				d.known[key] = known
+			}
+		}
+		if !ok {
+			d.known[key] = &discovered{device: dev, lastSeen: now}
+			if !d.emit(ctx, DiscoveryEvent{Type: DeviceAdded, Device: dev}) {
+				return
+			}
+			continue
+		}
+		changed := !known.device.Equal(dev)
+		known.device = dev
+		known.lastSeen = now
+		if changed && !d.emit(ctx, DiscoveryEvent{Type: DeviceUpdated, Device: dev}) {
+			return
+		}
+	}
+
+	for key, known := range d.known {
+		if now.Sub(known.lastSeen) < d.expiry(known.device) {
+			continue
+		}
+		delete(d.known, key)
+		log.WithFields(log.Fields{
+			"name":     known.device.Name,
+			"addr":     known.device.IP.String(),
+			"lastSeen": known.lastSeen,
+		}).Debug("device stopped responding")
+		if !d.emit(ctx, DiscoveryEvent{Type: DeviceRemoved, Device: known.device}) {
+			return
+		}
+	}
+}
+
+// moved finds the known device which dev moved from, one with the same model and name whose IP
+// didn't respond, and stops tracking it at its old IP
+func (d *Discoverer) moved(dev *protov1.Device, responded map[string]bool) (*discovered, bool) {
+	for key, known := range d.known {
+		if responded[key] || known.device.Model != dev.Model || known.device.Name != dev.Name {
+			continue
+		}
+		delete(d.known, key)
+		log.WithFields(log.Fields{
+			"name": dev.Name,
+			"from": key,
+			"to":   dev.IP.String(),
+		}).Debug("device changed IP")
+		return known, true
+	}
+	return nil, false
+}
+
+// expiry is how long dev can go without responding before it's removed, which is MissedKeepAlives of
+// its keepAlive periods, or of sweep intervals if it didn't advertise one
+func (d *Discoverer) expiry(dev *protov1.Device) time.Duration {
+	period := dev.KeepAlive
+	if period <= 0 {
+		period = d.Interval
+	}
+	missed := d.MissedKeepAlives
+	if missed < 1 {
+		missed = 1
+	}
+	return period * time.Duration(missed)
+}
+
+// emit sends e to Events, returning false if ctx was closed first
+func (d *Discoverer) emit(ctx context.Context, e DiscoveryEvent) bool {
+	select {
+	case d.events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
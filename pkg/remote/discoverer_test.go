@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"context"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestDiscoverer makes a Discoverer whose events are buffered, so update never blocks
+func newTestDiscoverer() *Discoverer {
+	d := NewDiscoverer(net.IPv4zero, nil)
+	d.events = make(chan DiscoveryEvent, 16)
+	return d
+}
+
+func testDevice(name string, ip string) *protov1.Device {
+	return &protov1.Device{Name: name, Model: "XMC-1", IP: net.ParseIP(ip), KeepAlive: 10 * time.Second}
+}
+
+// events returns the events emitted so far
+func events(d *Discoverer) []DiscoveryEvent {
+	var got []DiscoveryEvent
+	for {
+		select {
+		case e := <-d.events:
+			got = append(got, e)
+		default:
+			return got
+		}
+	}
+}
+
+func TestDiscovererSharedName(t *testing.T) {
+	d := newTestDiscoverer()
+	ctx := context.Background()
+	now := time.Now()
+
+	d.update(ctx, []*protov1.Device{testDevice("XMC-1", "10.0.0.2"), testDevice("XMC-1", "10.0.0.3")}, now)
+	got := events(d)
+	if len(got) != 2 || got[0].Type != DeviceAdded || got[1].Type != DeviceAdded {
+		t.Fatalf("got %+v, want both devices added", got)
+	}
+
+	// both keep answering, so nothing changes
+	for i := 1; i <= 3; i++ {
+		d.update(ctx, []*protov1.Device{testDevice("XMC-1", "10.0.0.3"), testDevice("XMC-1", "10.0.0.2")}, now.Add(time.Duration(i)*10*time.Second))
+		if got := events(d); len(got) != 0 {
+			t.Fatalf("got %+v, want no events", got)
+		}
+	}
+
+	// one stops answering while the other still does, and it's removed
+	last := now.Add(30 * time.Second)
+	for i := 1; i <= DefaultMissedKeepAlives; i++ {
+		d.update(ctx, []*protov1.Device{testDevice("XMC-1", "10.0.0.2")}, last.Add(time.Duration(i)*10*time.Second))
+	}
+	got = events(d)
+	if len(got) != 1 || got[0].Type != DeviceRemoved || got[0].Device.IP.String() != "10.0.0.3" {
+		t.Fatalf("got %+v, want 10.0.0.3 removed", got)
+	}
+}
+
+func TestDiscovererDeviceChangedIP(t *testing.T) {
+	d := newTestDiscoverer()
+	ctx := context.Background()
+	now := time.Now()
+
+	d.update(ctx, []*protov1.Device{testDevice("living", "10.0.0.2")}, now)
+	events(d)
+
+	d.update(ctx, []*protov1.Device{testDevice("living", "10.0.0.9")}, now.Add(10*time.Second))
+	got := events(d)
+	if len(got) != 1 || got[0].Type != DeviceUpdated || got[0].Device.IP.String() != "10.0.0.9" {
+		t.Fatalf("got %+v, want living updated to 10.0.0.9", got)
+	}
+	if _, ok := d.known["10.0.0.2"]; ok {
+		t.Error("device still known at its old IP")
+	}
+}
+
+func TestDiscovererSameNameNewIP(t *testing.T) {
+	d := newTestDiscoverer()
+	ctx := context.Background()
+	now := time.Now()
+
+	d.update(ctx, []*protov1.Device{testDevice("XMC-1", "10.0.0.2")}, now)
+	events(d)
+
+	// the known device still answers, so the new one isn't taken for it moving
+	d.update(ctx, []*protov1.Device{testDevice("XMC-1", "10.0.0.2"), testDevice("XMC-1", "10.0.0.3")}, now.Add(10*time.Second))
+	got := events(d)
+	if len(got) != 1 || got[0].Type != DeviceAdded || got[0].Device.IP.String() != "10.0.0.3" {
+		t.Fatalf("got %+v, want 10.0.0.3 added", got)
+	}
+}
@@ -0,0 +1,52 @@
+package remote
+
+import (
+	"fmt"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"strings"
+)
+
+// NakError is returned when a device refuses one or more commands
+type NakError struct {
+	Commands []protov1.CommandTag
+}
+
+func (e *NakError) Error() string {
+	return "device refused commands: " + joinCommandTags(e.Commands)
+}
+
+// TimeoutError is returned when a device doesn't reply before the context deadline
+type TimeoutError struct {
+	// Pending holds any commands which weren't acknowledged
+	Pending []protov1.CommandTag
+}
+
+func (e *TimeoutError) Error() string {
+	if len(e.Pending) == 0 {
+		return "timed out waiting for device to reply"
+	}
+	return "timed out waiting for device to acknowledge commands: " + joinCommandTags(e.Pending)
+}
+
+// Timeout reports that the error is a timeout, matching net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// MalformedResponseError is returned when a device replies with a packet which can't be decoded
+type MalformedResponseError struct {
+	Packet []byte
+	Err    error
+}
+
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("malformed response from device: %v: %q", e.Err, e.Packet)
+}
+
+func joinCommandTags(tags []protov1.CommandTag) string {
+	strs := make([]string, 0, len(tags))
+	for _, t := range tags {
+		strs = append(strs, t.String())
+	}
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,125 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// BroadcastAddr is the directed broadcast address of one IPv4 subnet of a local interface
+type BroadcastAddr struct {
+	// Interface is the name of the interface the subnet is on
+	Interface string
+	// Local is the interface's address on the subnet
+	Local net.IP
+	// Broadcast is the subnet's broadcast address
+	Broadcast net.IP
+	// Network is the subnet
+	Network *net.IPNet
+}
+
+// InterfaceBroadcasts returns the broadcast address of each IPv4 subnet of the local interfaces which
+// are up and support broadcast. If name is set, only the subnets of the interface with that name are
+// returned, and it's an error if it has none
+func InterfaceBroadcasts(name string) ([]BroadcastAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]BroadcastAddr, 0)
+	for _, iface := range ifaces {
+		if name != "" && iface.Name != name {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ifaceAddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			mask := ipnet.Mask
+			if ip == nil {
+				continue
+			}
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				broadcast[i] = ip[i] | ^mask[i]
+			}
+			addrs = append(addrs, BroadcastAddr{
+				Interface: iface.Name,
+				Local:     ip,
+				Broadcast: broadcast,
+				Network:   &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+			})
+		}
+	}
+
+	if name != "" && len(addrs) == 0 {
+		return nil, errors.New("no IPv4 broadcast subnets on interface " + name)
+	}
+	return addrs, nil
+}
+
+// InterfaceFor returns the name of the local interface on the same IPv4 subnet as ip, or an empty
+// string if there isn't one, e.g. for devices reached through a router
+func InterfaceFor(ip net.IP) string {
+	addrs, err := InterfaceBroadcasts("")
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if a.Network.Contains(ip) {
+			return a.Interface
+		}
+	}
+	return ""
+}
+
+// MaxNetworkHosts is the most addresses NetworkHosts expands a network to
+const MaxNetworkHosts = 65536
+
+// NetworkHosts returns every host address in an IPv4 network, in order. The network and broadcast
+// addresses are left out of networks large enough to have them
+func NetworkHosts(n *net.IPNet) ([]net.IP, error) {
+	ip := n.IP.To4()
+	if ip == nil {
+		return nil, errors.New("only IPv4 networks can be swept: " + n.String())
+	}
+	ones, bits := n.Mask.Size()
+	if bits == net.IPv6len*8 {
+		ones -= 96
+		bits = 32
+	}
+	if ones < 0 || bits != 32 {
+		return nil, errors.New("invalid network mask: " + n.String())
+	}
+	size := uint64(1) << uint(bits-ones)
+	if size > MaxNetworkHosts {
+		return nil, fmt.Errorf("network %s has more than %d addresses", n, MaxNetworkHosts)
+	}
+
+	first := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	first &= ^uint32(0) << uint(bits-ones)
+	start, end := uint64(0), size
+	// /31 and /32 networks have no network or broadcast address
+	if size > 2 {
+		start, end = 1, size-1
+	}
+	hosts := make([]net.IP, 0, end-start)
+	for i := start; i < end; i++ {
+		v := first + uint32(i)
+		hosts = append(hosts, net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4())
+	}
+	return hosts, nil
+}
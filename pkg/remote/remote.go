@@ -1,87 +1,179 @@
 package remote
 
 import (
-	"bytes"
 	"context"
 	"encoding/xml"
 	"fmt"
 	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sync"
+	"time"
 )
 
+// Remote sends commands to a device and receives its replies
 type Remote struct {
-	Name          string
-	Model         string
-	ControlAddr   net.UDPAddr
-	NotifyAddr    net.UDPAddr
-	InfoAddr      net.UDPAddr
-	Subscriptions []string
+	protov1.Device
+	// BindIP is the local address replies from the device are received on, every address if it's nil
+	BindIP net.IP
+	// Retry controls how packets sent to the device's control port are resent
+	Retry RetryPolicy
 }
 
-func NewRemote(name string, model string, controlAddr net.UDPAddr, notifyAddr net.UDPAddr, infoAddr net.UDPAddr) *Remote {
-	return &Remote{
-		Name:        name,
-		Model:       model,
-		ControlAddr: controlAddr,
-		NotifyAddr:  notifyAddr,
-		InfoAddr:    infoAddr,
-	}
-}
-
-func NewRemoteFromTransponderResponse(addr *net.UDPAddr, tr protov1.SelfIdentityResponse) *Remote {
-	r := NewRemote(
-		tr.Name,
-		tr.Model,
-		net.UDPAddr{
-			IP:   addr.IP,
-			Port: tr.Control.ControlPort,
-		},
-		net.UDPAddr{
-			IP:   addr.IP,
-			Port: tr.Control.NotifyPort,
-		},
-		net.UDPAddr{
-			IP:   addr.IP,
-			Port: tr.Control.NotifyPort,
-		},
-	)
-	return r
-}
-
-func sendDiscoveryPacket(dstAddr *net.UDPAddr) error {
-	packet := bytes.NewBuffer([]byte{})
-	packet.Write([]byte(xml.Header))
-	data, err := xml.Marshal(protov1.SelfIdentityRequest{})
+func sendDiscoveryPacket(dstAddr *net.UDPAddr, protocol string) error {
+	packet, err := protov1.MarshalPacket(protov1.SelfIdentityRequest{Protocol: protocol})
 	if err != nil {
 		return err
 	}
-	packet.Write(data)
 
 	// Create a connection without peers to send the broadcast packet on
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
-	defer conn.Close()
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	nbytes, err := conn.WriteToUDP(packet.Bytes(), dstAddr)
+	nbytes, err := conn.WriteToUDP(packet, dstAddr)
 	if err != nil {
 		return err
 	}
 	log.WithFields(log.Fields{
 		"addr":   dstAddr.String(),
 		"nbytes": nbytes,
-		"data":   fmt.Sprintf("%s", packet.Bytes()),
+		"data":   fmt.Sprintf("%s", packet),
 	}).Debug("sent discovery packet")
 
 	return nil
 }
 
-// DiscoverTransponders broadcasts a discovery packet and listens for responses on the passed bindAddr
-func DiscoverTransponders(ctx context.Context, bind net.IP, dests []net.IP) ([]*Remote, error) {
-	found := make([]*Remote, 0)
-	remotes := make(chan *Remote, 10)
+// DiscoveryOptions limits how quickly discovery packets are sent, for sweeping large address ranges
+type DiscoveryOptions struct {
+	// Rate is the most packets sent per second, unlimited if it's 0
+	Rate int
+	// Concurrency is the most packets being sent at once, unlimited if it's 0
+	Concurrency int
+	// Protocol is the protocol version requested in discovery packets. Devices advertise protocol 2.0
+	// if it's empty
+	Protocol string
+	// Networks limits responses to devices on these networks or at one of the addresses packets were
+	// sent to, if it's set
+	Networks []*net.IPNet
+}
+
+// accepts reports whether a response from ip is kept, given the addresses packets were sent to
+func (o DiscoveryOptions) accepts(ip net.IP, dests map[string]bool) bool {
+	if len(o.Networks) == 0 || dests[ip.String()] {
+		return true
+	}
+	for _, n := range o.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// interval returns the time between packets allowed by Rate, 0 if it's unlimited. Rates too high to
+// be told apart from unlimited are treated as unlimited
+func (o DiscoveryOptions) interval() time.Duration {
+	if o.Rate <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(o.Rate)
+}
+
+// SendDuration returns how long sending n discovery packets takes at Rate. Discovery should wait at
+// least this long for responses, plus the time it takes for the last device to respond
+func (o DiscoveryOptions) SendDuration(n int) time.Duration {
+	if n < 2 {
+		return 0
+	}
+	return o.interval() * time.Duration(n-1)
+}
+
+// sendDiscoveryPackets sends a discovery packet to each of dests, limited by opts, until every
+// packet is sent or ctx is closed. An error is only returned if every packet failed to send
+func sendDiscoveryPackets(ctx context.Context, dests []net.IP, opts DiscoveryOptions) error {
+	var tick <-chan time.Time
+	if interval := opts.interval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 || concurrency > len(dests) {
+		concurrency = len(dests)
+	}
+	slots := make(chan struct{}, concurrency)
+
+	wg := &sync.WaitGroup{}
+	mu := &sync.Mutex{}
+	var failures int
+	var lastErr error
+	// unsent logs the addresses which discovery ended before reaching
+	unsent := func(i int) error {
+		wg.Wait()
+		log.WithFields(log.Fields{
+			"unsent": len(dests) - i,
+			"total":  len(dests),
+		}).Warn("discovery ended before every discovery packet was sent")
+		return nil
+	}
+	for i, dest := range dests {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return unsent(i)
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return unsent(i)
+		}
+
+		wg.Add(1)
+		go func(dest net.IP) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			destAddr := &net.UDPAddr{
+				IP:   dest,
+				Port: protov1.SelfIdentityRequestPort,
+			}
+			err := sendDiscoveryPacket(destAddr, opts.Protocol)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"addr": destAddr,
+				}).Warn("error sending discovery packet")
+				mu.Lock()
+				failures++
+				lastErr = err
+				mu.Unlock()
+			}
+		}(dest)
+	}
+	wg.Wait()
+
+	if failures > 0 && failures == len(dests) {
+		return lastErr
+	}
+	return nil
+}
+
+// DiscoverTransponders broadcasts a discovery packet requesting protocol 3.0 and listens for responses
+// on the passed bindAddr
+func DiscoverTransponders(ctx context.Context, bind net.IP, dests []net.IP) ([]*protov1.Device, error) {
+	return DiscoverTranspondersWithOptions(ctx, bind, dests, DiscoveryOptions{Protocol: protov1.ProtocolVersion3})
+}
+
+// DiscoverTranspondersWithOptions sends a discovery packet to each of dests as quickly as opts allows,
+// and listens for responses on the passed bindAddr until ctx is closed. Responses are received while
+// packets are still being sent. Addresses which can't be sent to are skipped, and an error is only
+// returned if none could be
+func DiscoverTranspondersWithOptions(ctx context.Context, bind net.IP, dests []net.IP, opts DiscoveryOptions) ([]*protov1.Device, error) {
+	found := make([]*protov1.Device, 0)
 
 	// bind to the port identity responses will be sent to
 	bindAddr := &net.UDPAddr{
@@ -89,7 +181,6 @@ func DiscoverTransponders(ctx context.Context, bind net.IP, dests []net.IP) ([]*
 		Port: protov1.SelfIdentityResponsePort,
 	}
 	listener, err := net.ListenUDP("udp", bindAddr)
-	defer listener.Close()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"addr": bind,
@@ -97,118 +188,108 @@ func DiscoverTransponders(ctx context.Context, bind net.IP, dests []net.IP) ([]*
 		}).Error("unable to bind to discovery response port")
 		return found, err
 	}
+	defer listener.Close()
 
-	// send the discovery packet
-	for _, dest := range dests {
-		destAddr := &net.UDPAddr{
-			IP:   dest,
-			Port: protov1.SelfIdentityRequestPort,
+	// send the discovery packets while the listener receives responses, stopping if discovery ends
+	// before they're all sent
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendDiscoveryPackets(ctx, dests, opts)
+	}()
+
+	direct := make(map[string]bool, len(dests))
+	for _, ip := range dests {
+		direct[ip.String()] = true
+	}
+
+	// devices answer every discovery packet which reaches them, so responses are deduplicated by
+	// the address they came from
+	foundByIP := make(map[string]int)
+	buf := make([]byte, maxPacketSize)
+	log.Debug("awaiting identity responses")
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("discovery context closed")
+			return found, nil
+		case err := <-sent:
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("error sending discovery packets")
+				return found, err
+			}
+		default:
+		}
+
+		// reads are bounded so that ctx is checked regularly
+		readDeadline := time.Now().Add(pollInterval)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(readDeadline) {
+			readDeadline = ctxDeadline
 		}
-		err = sendDiscoveryPacket(destAddr)
+		err := listener.SetReadDeadline(readDeadline)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"err":  err,
-				"addr": destAddr,
-			}).Error("error sending discovery packet")
 			return found, err
 		}
-	}
 
-	// setup a routine to loop over all responses received by the listener
-	go func() {
-		respPacket := make([]byte, 2048)
-		log.Debug("awaiting identity responses")
-		for {
-			// if our parent context was closed, exit the read loop
-			select {
-			case <-ctx.Done():
-				log.Info("context closed, discovery listener terminating")
-				return
-			default:
+		n, raddr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
 			}
-
-			// we'll need the remote address from the packets to build the remotes
-			_, raddr, err := listener.ReadFromUDP(respPacket)
-			if err != nil {
-				// handle errors returned by the reader based on type
-				if operr, ok := err.(*net.OpError); ok {
-					fs := log.Fields{
-						"err":  operr,
-						"errT": fmt.Sprintf("%T", operr),
-					}
-					if operr.Temporary() {
-						// if the error indicates that it's temporary, retry
-						log.WithFields(fs).Warn("temporary operror while reading discovery responses")
-						continue
-					} else if operr.Err.Error() == "use of closed network connection" {
-						// if the nested error is due to the connection closing, we're done
-						log.WithFields(fs).Debug("discovery listener connection closed")
-						return
-					} else {
-						// log unknowns
-						log.WithFields(fs).Error("unknown operror while reading discovery responses")
-						return
-					}
-				}
-				// if the error isn't a known type, also log its type for debugging and retry
+			if operr, ok := err.(*net.OpError); ok && operr.Temporary() {
 				log.WithFields(log.Fields{
-					"addr": raddr,
-					"err":  err,
-					"errt": fmt.Sprintf("%T", err),
-				}).Error("unknown error reading ident response packet")
+					"err": err,
+				}).Warn("temporary error while reading discovery responses")
 				continue
 			}
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("error reading discovery responses")
+			return found, err
+		}
+		packet := buf[:n]
+		log.WithFields(log.Fields{
+			"addr": raddr,
+			"body": string(packet),
+		}).Debug("got packet on ident response port")
+
+		if !opts.accepts(raddr.IP, direct) {
 			log.WithFields(log.Fields{
 				"addr": raddr,
-				"body": string(bytes.Trim(respPacket, "\x00")),
-			}).Debug("got packet on ident response port")
+			}).Debug("ignoring response from outside the searched networks")
+			continue
+		}
 
-			tr := protov1.SelfIdentityResponse{}
-			err = xml.Unmarshal(respPacket, &tr)
-			if err != nil {
-				// if we encounter a decoding error, log it, reset the buffer, and loop again
-				log.WithFields(log.Fields{
-					"packet": string(respPacket),
-					"err":    err,
-					"from":   raddr,
-				}).Error("error decoding response packet")
-				respPacket = respPacket[0:0]
-				continue
-			}
+		tr := protov1.SelfIdentityResponse{}
+		err = xml.Unmarshal(packet, &tr)
+		if err != nil {
 			log.WithFields(log.Fields{
-				"addr":       raddr.String(),
-				"model":      tr.Model,
-				"name":       tr.Name,
-				"apiVersion": tr.Control.Version,
-			}).Debug("found transponder")
-			respPacket = respPacket[0:0]
-
-			remote := NewRemoteFromTransponderResponse(
-				raddr,
-				tr,
-			)
-			remotes <- remote
+				"packet": string(packet),
+				"err":    err,
+				"from":   raddr,
+			}).Error("error decoding response packet")
+			continue
 		}
-	}()
 
-	// once the receiver loop is setup, process the results it sends over its channel or wait
-	// for our context to be closed
-	for {
-		select {
-		case <-ctx.Done():
-			// if our context is closed, our work is done and we should return results
-			log.Debug("discovery context closing")
-			// close the listener connection, this will cause the receiver loop to exit
-			err := listener.Close()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Debug("error closing discovery listener?")
-			}
-			return found, nil
-		case r := <-remotes:
-			// as new results are found, copy them into our results slice
-			found = append(found, r)
+		device := protov1.NewDeviceFromSelfIdentityResponse(raddr.IP, &tr)
+		// only devices on a local subnet get an interface, the one a response arrived on isn't known
+		device.Interface = InterfaceFor(raddr.IP)
+		key := raddr.IP.String()
+		if i, ok := foundByIP[key]; ok {
+			// keep the latest response in case the device changed in between
+			found[i] = device
+			continue
 		}
+		log.WithFields(log.Fields{
+			"addr":       raddr.String(),
+			"model":      tr.Model,
+			"name":       tr.Name,
+			"apiVersion": tr.Control.Version,
+		}).Debug("found transponder")
+		foundByIP[key] = len(found)
+		found = append(found, device)
 	}
 }
@@ -0,0 +1,29 @@
+package remote
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDiscoveryOptionsAccepts(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, vlan, _ := net.ParseCIDR("10.20.0.0/24")
+	dests := map[string]bool{"172.16.0.5": true}
+	tests := []struct {
+		ip       string
+		networks []*net.IPNet
+		want     bool
+	}{
+		{ip: "10.9.9.9", want: true},
+		{ip: "192.168.1.20", networks: []*net.IPNet{lan, vlan}, want: true},
+		{ip: "10.20.0.7", networks: []*net.IPNet{lan, vlan}, want: true},
+		{ip: "172.16.0.5", networks: []*net.IPNet{lan}, want: true},
+		{ip: "192.168.2.20", networks: []*net.IPNet{lan, vlan}, want: false},
+	}
+	for _, tt := range tests {
+		opts := DiscoveryOptions{Networks: tt.networks}
+		if got := opts.accepts(net.ParseIP(tt.ip), dests); got != tt.want {
+			t.Errorf("accepts(%s) with networks %v = %v, want %v", tt.ip, tt.networks, got, tt.want)
+		}
+	}
+}
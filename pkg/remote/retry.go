@@ -0,0 +1,49 @@
+package remote
+
+import "time"
+
+// RetryPolicy controls how packets are resent when a device doesn't reply. UDP packets to and from
+// devices are regularly lost on busy or wireless networks.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a packet is sent, including the first
+	Attempts int
+	// Backoff is how long to wait for a reply before sending the packet again
+	Backoff time.Duration
+	// Multiplier scales Backoff after each attempt
+	Multiplier float64
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used by Remotes made with NewRemoteFromDevice
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   4,
+	Backoff:    250 * time.Millisecond,
+	Multiplier: 2,
+	MaxBackoff: 2 * time.Second,
+}
+
+// attempts returns the number of times a packet should be sent, at least once
+func (p RetryPolicy) attempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// backoff returns how long to wait for a reply after the passed attempt, counting from 1
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	if wait <= 0 {
+		wait = DefaultRetryPolicy.Backoff
+	}
+	for i := 1; i < attempt; i++ {
+		if p.Multiplier > 1 {
+			wait = time.Duration(float64(wait) * p.Multiplier)
+		}
+		if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return wait
+}
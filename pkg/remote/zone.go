@@ -0,0 +1,101 @@
+package remote
+
+import (
+	"errors"
+	protov1 "git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"strings"
+)
+
+// ZoneID identifies one of the zones of a device
+type ZoneID int
+
+const (
+	// MainZone is the zone most commands apply to
+	MainZone ZoneID = 1
+	// Zone2 is the second zone, with its own power, volume and input
+	Zone2 ZoneID = 2
+)
+
+func (id ZoneID) String() string {
+	switch id {
+	case MainZone:
+		return "main"
+	case Zone2:
+		return "zone2"
+	}
+	return "unknown"
+}
+
+// ParseZone returns the zone named s, which is main, zone2 or the zone's number
+func ParseZone(s string) (ZoneID, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "main", "1", "zone1":
+		return MainZone, nil
+	case "2", "zone2":
+		return Zone2, nil
+	}
+	return 0, errors.New("unknown zone: " + s)
+}
+
+// zoneTags are the tags used to control a zone
+type zoneTags struct {
+	powerOn       protov1.CommandTag
+	powerOff      protov1.CommandTag
+	powerProperty protov1.NotificationTag
+	setVolume     protov1.CommandTag
+	volume        protov1.CommandTag
+	mute          protov1.CommandTag
+	muteOn        protov1.CommandTag
+	muteOff       protov1.CommandTag
+	inputs        map[string]protov1.CommandTag
+}
+
+var zones = map[ZoneID]zoneTags{
+	MainZone: {
+		powerOn:       protov1.PowerOnCommand,
+		powerOff:      protov1.PowerOffCommand,
+		powerProperty: protov1.PowerNotification,
+		setVolume:     protov1.SetVolumeCommand,
+		volume:        protov1.VolumeCommand,
+		mute:          protov1.MuteCommand,
+		muteOn:        protov1.MuteOnCommand,
+		muteOff:       protov1.MuteOffCommand,
+		inputs:        mainInputCommands,
+	},
+	Zone2: {
+		powerOn:       protov1.Zone2PowerOnCommand,
+		powerOff:      protov1.Zone2PowerOffCommand,
+		powerProperty: protov1.Zone2PowerNotification,
+		setVolume:     protov1.Zone2SetVolumeCommand,
+		volume:        protov1.Zone2VolumeCommand,
+		mute:          protov1.Zone2MuteCommand,
+		muteOn:        protov1.Zone2MuteOnCommand,
+		muteOff:       protov1.Zone2MuteOffCommand,
+		inputs:        zone2InputCommands,
+	},
+}
+
+// Zone controls one zone of a device, sending the commands for that zone through its Remote
+type Zone struct {
+	ID     ZoneID
+	remote *Remote
+	tags   zoneTags
+}
+
+// Zone returns the zone of the device with the passed ID
+func (r *Remote) Zone(id ZoneID) (*Zone, error) {
+	tags, ok := zones[id]
+	if !ok {
+		return nil, errors.New("unknown zone: " + id.String())
+	}
+	return &Zone{
+		ID:     id,
+		remote: r,
+		tags:   tags,
+	}, nil
+}
+
+// String names the zone along with its device, e.g. living-room/zone2
+func (z *Zone) String() string {
+	return z.remote.Name + "/" + z.ID.String()
+}
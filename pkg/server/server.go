@@ -1,25 +1,372 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	log "github.com/sirupsen/logrus"
 	"net"
+	"sync"
 )
 
+// maxPacketSize is the largest packet expected from a device
+const maxPacketSize = 8192
+
+// DefaultBufferSize is the capacity of each RegisteredDevice channel unless the Server sets another
+const DefaultBufferSize = 16
+
+// RegisteredDevice is a device whose packets are delivered by a Server. Packets are dropped if the
+// corresponding channel is full, and each channel is closed when the device is unregistered.
 type RegisteredDevice struct {
 	v1.Device
+	// Updates receives the device's replies to UpdateRequests
 	Updates chan v1.UpdateResponse
+	// Notifications receives the device's notifications of subscribed property changes
 	Notifications chan v1.Notification
+	// Controls receives the device's acknowledgements of ControlRequests
 	Controls chan v1.ControlResponse
-	Subscriptions map[v1.NotificationTag]
+
+	// mu guards the remaining fields
+	mu sync.RWMutex
+	// subscriptions holds the last known state of each property the device acknowledged a
+	// subscription to
+	subscriptions map[v1.NotificationTag]v1.Property
+	subscribers   []*Subscriber
+	// refs counts the subscribers of each tag
+	refs   map[v1.NotificationTag]int
+	closed bool
 }
 
+// Server receives packets from every registered device on a single pair of control and notify
+// ports, and delivers them to the device they came from
 type Server struct {
-	// Devices is a list of all registered devices
-	Devices []v1.Device
-	// DevicesByIp is a mapping of IPs, in string form, to their corresponding devices
-	DevicesByIp map[int]*v1.Device
-	// UDPListeners is a mapping of port numbers to corresponding connections
-	UDPListeners map[int]*net.UDPConn
+	// BindIP is the local address the ports are bound to
+	BindIP net.IP
+	// ControlPort is the local port devices send replies to control packets to
+	ControlPort int
+	// NotifyPort is the local port devices send notifications to
+	NotifyPort int
+	// BufferSize is the capacity of the channels of devices registered with the Server
+	BufferSize int
+
+	mu sync.RWMutex
+	// devicesByIP is a mapping of IPs, in string form, to their corresponding devices
+	devicesByIP map[string]*RegisteredDevice
+	// udpListeners is a mapping of port numbers to corresponding connections
+	udpListeners map[int]*net.UDPConn
+}
+
+// NewServer makes a Server listening on the default ports of bind
+func NewServer(bind net.IP) *Server {
+	return &Server{
+		BindIP:      bind,
+		ControlPort: v1.DefaultControlPort,
+		NotifyPort:  v1.DefaultNotifyPort,
+		BufferSize:  DefaultBufferSize,
+		devicesByIP: make(map[string]*RegisteredDevice),
+	}
+}
+
+// Listen binds the Server's ports. It's called by Serve if needed, but must be called first for
+// packets to be sent to devices before Serve is running
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.udpListeners != nil {
+		return nil
+	}
+
+	listeners := make(map[int]*net.UDPConn)
+	for _, port := range []int{s.ControlPort, s.NotifyPort} {
+		if _, ok := listeners[port]; ok {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.BindIP, Port: port})
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners[port] = conn
+	}
+	s.udpListeners = listeners
+	return nil
+}
+
+// Serve receives packets on the Server's ports until ctx is closed, then closes the ports and
+// unregisters every device
+func (s *Server) Serve(ctx context.Context) error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	wg := &sync.WaitGroup{}
+	for port, conn := range s.udpListeners {
+		wg.Add(1)
+		go func(port int, conn *net.UDPConn) {
+			defer wg.Done()
+			s.receive(port, conn)
+		}(port, conn)
+	}
+	s.mu.RUnlock()
+
+	<-ctx.Done()
+	log.Debug("context closed, server shutting down")
+
+	s.mu.Lock()
+	// closing the listeners causes the receive loops to exit
+	for _, conn := range s.udpListeners {
+		conn.Close()
+	}
+	s.udpListeners = nil
+	for ip, d := range s.devicesByIP {
+		delete(s.devicesByIP, ip)
+		d.close()
+	}
+	s.mu.Unlock()
+
+	wg.Wait()
+	return nil
+}
+
+// RegisterDevice starts delivering packets sent from the device's IP
+func (s *Server) RegisterDevice(device v1.Device) (*RegisteredDevice, error) {
+	bufferSize := s.BufferSize
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	rd := &RegisteredDevice{
+		Device:        device,
+		Updates:       make(chan v1.UpdateResponse, bufferSize),
+		Notifications: make(chan v1.Notification, bufferSize),
+		Controls:      make(chan v1.ControlResponse, bufferSize),
+		subscriptions: make(map[v1.NotificationTag]v1.Property),
+		refs:          make(map[v1.NotificationTag]int),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := device.IP.String()
+	if _, ok := s.devicesByIP[key]; ok {
+		return nil, errors.New("device already registered: " + key)
+	}
+	s.devicesByIP[key] = rd
+	return rd, nil
+}
+
+// UnregisterDevice stops delivering packets sent from ip, and closes the registered device's channels
+func (s *Server) UnregisterDevice(ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ip.String()
+	d, ok := s.devicesByIP[key]
+	if !ok {
+		return errors.New("device not registered: " + key)
+	}
+	delete(s.devicesByIP, key)
+	d.close()
+	return nil
+}
+
+// Device returns the device registered for ip, if any
+func (s *Server) Device(ip net.IP) (*RegisteredDevice, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.devicesByIP[ip.String()]
+	return d, ok
+}
+
+// Send writes req to the control port of the device registered for ip, from the Server's control
+// port so that the reply is delivered to the device's channels
+func (s *Server) Send(ip net.IP, req interface{}) error {
+	packet, err := v1.MarshalPacket(req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.devicesByIP[ip.String()]
+	if !ok {
+		return errors.New("device not registered: " + ip.String())
+	}
+	conn, ok := s.udpListeners[s.ControlPort]
+	if !ok {
+		return errors.New("server isn't listening")
+	}
+	nbytes, err := conn.WriteToUDP(packet, &d.ControlAddr)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"addr":   d.ControlAddr.String(),
+		"nbytes": nbytes,
+		"data":   string(packet),
+	}).Debug("sent control packet")
+	return nil
+}
+
+// receive reads packets from conn until it's closed, delivering each to the device it came from
+func (s *Server) receive(port int, conn *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.WithFields(log.Fields{
+					"port": port,
+				}).Debug("server listener closed")
+				return
+			}
+			// errors like ICMP port unreachables from devices don't stop the listener
+			log.WithFields(log.Fields{
+				"port": port,
+				"err":  err,
+			}).Warn("error while reading from devices")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"addr": raddr,
+			"port": port,
+			"body": string(buf[:n]),
+		}).Debug("got packet from device")
+
+		v, err := v1.DecodePacket(buf[:n])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"addr":   raddr,
+				"err":    err,
+				"packet": string(buf[:n]),
+			}).Error("error decoding packet from device")
+			continue
+		}
+
+		d, ok := s.Device(raddr.IP)
+		if !ok {
+			log.WithFields(log.Fields{
+				"addr": raddr,
+			}).Debug("ignoring packet from unregistered device")
+			continue
+		}
+		d.deliver(v)
+	}
 }
 
-func (s *Server) RegisterDevice(device v1.Device) {}
+// deliver sends a decoded packet to the matching channel, dropping it if the channel is full, and
+// fans out any property changes to the device's subscribers
+func (d *RegisteredDevice) deliver(v interface{}) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	var dropped bool
+	var changes []v1.Property
+	switch p := v.(type) {
+	case *v1.ControlResponse:
+		select {
+		case d.Controls <- *p:
+		default:
+			dropped = true
+		}
+	case *v1.UpdateResponse:
+		select {
+		case d.Updates <- *p:
+		default:
+			dropped = true
+		}
+	case *v1.Notification:
+		for _, prop := range p.Properties {
+			if _, ok := d.subscriptions[prop.Tag]; ok {
+				d.subscriptions[prop.Tag] = prop
+			}
+		}
+		changes = p.Properties
+		select {
+		case d.Notifications <- *p:
+		default:
+			dropped = true
+		}
+	case *v1.SubscribeResponse:
+		for _, prop := range p.Properties {
+			if prop.Status == v1.StatusAck {
+				d.subscriptions[prop.Tag] = prop
+				// a subscribe request is only sent for tags without subscribers, so the current
+				// values in the response are new to every subscriber of those tags
+				changes = append(changes, prop)
+			}
+		}
+	case *v1.UnsubscribeResponse:
+		for _, prop := range p.Properties {
+			if prop.Status == v1.StatusAck {
+				delete(d.subscriptions, prop.Tag)
+			}
+		}
+	default:
+		log.WithFields(log.Fields{
+			"device": d.Name,
+			"type":   fmt.Sprintf("%T", v),
+		}).Debug("ignoring unexpected packet from device")
+	}
+	subscribers := d.subscribersCopy()
+	d.mu.Unlock()
+
+	if dropped {
+		log.WithFields(log.Fields{
+			"device": d.Name,
+			"type":   fmt.Sprintf("%T", v),
+		}).Warn("channel full, dropped packet from device")
+	}
+	// subscribers may block, so they're delivered to without holding the device's lock
+	for _, sub := range subscribers {
+		for _, prop := range changes {
+			if sub.tags[prop.Tag] {
+				sub.deliver(prop, sub.Policy == BlockPolicy)
+			}
+		}
+	}
+}
+
+// close closes the device's channels and those of its subscribers
+func (d *RegisteredDevice) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.Updates)
+	close(d.Notifications)
+	close(d.Controls)
+	subscribers := d.subscribers
+	d.subscribers = nil
+	d.refs = make(map[v1.NotificationTag]int)
+	d.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.shutdown()
+	}
+}
+
+// Subscriptions returns the last known state of each property the device acknowledged a
+// subscription to
+func (d *RegisteredDevice) Subscriptions() map[v1.NotificationTag]v1.Property {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	subscriptions := make(map[v1.NotificationTag]v1.Property, len(d.subscriptions))
+	for tag, prop := range d.subscriptions {
+		subscriptions[tag] = prop
+	}
+	return subscriptions
+}
+
+// subscribersCopy returns the device's current subscribers, d.mu must be held
+func (d *RegisteredDevice) subscribersCopy() []*Subscriber {
+	subscribers := make([]*Subscriber, len(d.subscribers))
+	copy(subscribers, d.subscribers)
+	return subscribers
+}
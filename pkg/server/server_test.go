@@ -0,0 +1,453 @@
+package server
+
+import (
+	"context"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevice answers subscribe and unsubscribe requests like a device, recording the tags of each
+// request it receives, and sends notifications to the last address which subscribed
+type fakeDevice struct {
+	conn *net.UDPConn
+
+	mu sync.Mutex
+	// values is the device's current value of each property
+	values map[v1.NotificationTag]string
+	// subscribed and unsubscribed hold the tags of each request received, in order
+	subscribed   [][]v1.NotificationTag
+	unsubscribed [][]v1.NotificationTag
+	// subscriber is where notifications are sent
+	subscriber *net.UDPAddr
+	sequence   int
+}
+
+// newFakeDevice starts a fakeDevice on ip with the passed property values
+func newFakeDevice(t *testing.T, ip net.IP, values map[v1.NotificationTag]string) *fakeDevice {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("unable to listen on %s: %v", ip, err)
+	}
+	if values == nil {
+		values = make(map[v1.NotificationTag]string)
+	}
+	f := &fakeDevice{conn: conn, values: values}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+	return f
+}
+
+// Device returns the device as it's registered with a Server
+func (f *fakeDevice) Device() v1.Device {
+	addr := *f.conn.LocalAddr().(*net.UDPAddr)
+	return v1.Device{Name: "fake", Model: "XMC-1", IP: addr.IP, ControlAddr: addr}
+}
+
+func (f *fakeDevice) serve() {
+	buf := make([]byte, 8192)
+	for {
+		n, raddr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// requests decode as the response with the same element, with each tag as a property
+		v, err := v1.DecodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		var reply interface{}
+		f.mu.Lock()
+		switch req := v.(type) {
+		case *v1.SubscribeResponse:
+			resp := v1.SubscribeResponse{}
+			f.subscribed = append(f.subscribed, propertyTags(req.Properties))
+			f.subscriber = raddr
+			for _, p := range req.Properties {
+				resp.Properties = append(resp.Properties, v1.Property{
+					Tag:     p.Tag,
+					Value:   f.values[p.Tag],
+					Visible: true,
+					Status:  v1.StatusAck,
+				})
+			}
+			reply = resp
+		case *v1.UnsubscribeResponse:
+			resp := v1.UnsubscribeResponse{}
+			f.unsubscribed = append(f.unsubscribed, propertyTags(req.Properties))
+			for _, p := range req.Properties {
+				resp.Properties = append(resp.Properties, v1.Property{Tag: p.Tag, Status: v1.StatusAck})
+			}
+			reply = resp
+		}
+		f.mu.Unlock()
+		if reply == nil {
+			continue
+		}
+		packet, err := v1.MarshalPacket(reply)
+		if err != nil {
+			return
+		}
+		f.conn.WriteToUDP(packet, raddr)
+	}
+}
+
+// notify changes the device's properties and notifies the subscriber of them
+func (f *fakeDevice) notify(t *testing.T, props ...v1.Property) {
+	f.mu.Lock()
+	n := v1.Notification{Sequence: f.sequence, Properties: props}
+	f.sequence++
+	for _, p := range props {
+		f.values[p.Tag] = p.Value
+	}
+	addr := f.subscriber
+	f.mu.Unlock()
+	if addr == nil {
+		t.Fatal("notify called before anything subscribed")
+	}
+	f.send(t, addr, n)
+}
+
+// send writes a packet to addr from the device
+func (f *fakeDevice) send(t *testing.T, addr *net.UDPAddr, v interface{}) {
+	packet, err := v1.MarshalPacket(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.conn.WriteToUDP(packet, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// requests returns the tags of the subscribe and unsubscribe requests received so far
+func (f *fakeDevice) requests() ([][]v1.NotificationTag, [][]v1.NotificationTag) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]v1.NotificationTag(nil), f.subscribed...), append([][]v1.NotificationTag(nil), f.unsubscribed...)
+}
+
+// waitForRequests waits for the device to have received the wanted subscribe and unsubscribe requests
+func (f *fakeDevice) waitForRequests(t *testing.T, subscribed, unsubscribed [][]v1.NotificationTag) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		gotSubscribed, gotUnsubscribed := f.requests()
+		if reflect.DeepEqual(gotSubscribed, subscribed) && reflect.DeepEqual(gotUnsubscribed, unsubscribed) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got subscribes %v and unsubscribes %v, want %v and %v", gotSubscribed, gotUnsubscribed, subscribed, unsubscribed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func propertyTags(props []v1.Property) []v1.NotificationTag {
+	tags := make([]v1.NotificationTag, 0, len(props))
+	for _, p := range props {
+		tags = append(tags, p.Tag)
+	}
+	return tags
+}
+
+// newTestServer starts a Server on a random port of 127.0.0.1 until the test ends
+func newTestServer(t *testing.T) *Server {
+	s := NewServer(net.IPv4(127, 0, 0, 1))
+	s.ControlPort = 0
+	s.NotifyPort = 0
+	err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Serve(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s
+}
+
+// notifyAddr returns the address s receives notifications on
+func notifyAddr(s *Server) *net.UDPAddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.udpListeners[s.NotifyPort].LocalAddr().(*net.UDPAddr)
+}
+
+// receive returns the next property from c, failing the test if none arrives
+func receive(t *testing.T, c <-chan v1.Property) v1.Property {
+	t.Helper()
+	select {
+	case p, ok := <-c:
+		if !ok {
+			t.Fatal("subscriber channel closed")
+		}
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a property")
+	}
+	return v1.Property{}
+}
+
+// expectNothing fails the test if a property is waiting in c
+func expectNothing(t *testing.T, c <-chan v1.Property) {
+	t.Helper()
+	select {
+	case p, ok := <-c:
+		if ok {
+			t.Errorf("got unexpected property %+v", p)
+		}
+	default:
+	}
+}
+
+func TestSubscribeReferenceCounting(t *testing.T) {
+	s := newTestServer(t)
+	f := newFakeDevice(t, net.IPv4(127, 0, 0, 2), map[v1.NotificationTag]string{
+		v1.VolumeNotification: "-30.0",
+		v1.SourceNotification: "HDMI 1",
+	})
+	d, err := s.RegisterDevice(f.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.Subscribe(d.IP, SubscribeOptions{BufferSize: 8}, v1.PowerNotification, v1.VolumeNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the current values arrive with the device's reply
+	got := map[v1.NotificationTag]string{}
+	for i := 0; i < 2; i++ {
+		p := receive(t, first.C)
+		got[p.Tag] = p.Value
+	}
+	if got[v1.VolumeNotification] != "-30.0" {
+		t.Errorf("got volume %q, want -30.0", got[v1.VolumeNotification])
+	}
+
+	second, err := s.Subscribe(d.IP, SubscribeOptions{BufferSize: 8}, v1.VolumeNotification, v1.SourceNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the tag without subscribers is requested, and the known volume is delivered immediately
+	f.waitForRequests(t, [][]v1.NotificationTag{
+		{v1.PowerNotification, v1.VolumeNotification},
+		{v1.SourceNotification},
+	}, nil)
+	got = map[v1.NotificationTag]string{}
+	for i := 0; i < 2; i++ {
+		p := receive(t, second.C)
+		got[p.Tag] = p.Value
+	}
+	if got[v1.VolumeNotification] != "-30.0" || got[v1.SourceNotification] != "HDMI 1" {
+		t.Errorf("got current values %v, want volume -30.0 and source HDMI 1", got)
+	}
+
+	f.notify(t, v1.Property{Tag: v1.VolumeNotification, Value: "-20.0", Visible: true})
+	if p := receive(t, first.C); p.Value != "-20.0" {
+		t.Errorf("first subscriber got %+v, want volume -20.0", p)
+	}
+	if p := receive(t, second.C); p.Value != "-20.0" {
+		t.Errorf("second subscriber got %+v, want volume -20.0", p)
+	}
+
+	// volume still has a subscriber, so only power is unsubscribed
+	err = first.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.waitForRequests(t, [][]v1.NotificationTag{
+		{v1.PowerNotification, v1.VolumeNotification},
+		{v1.SourceNotification},
+	}, [][]v1.NotificationTag{
+		{v1.PowerNotification},
+	})
+	if _, ok := <-first.C; ok {
+		t.Error("closed subscriber's channel wasn't closed")
+	}
+
+	err = second.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.waitForRequests(t, [][]v1.NotificationTag{
+		{v1.PowerNotification, v1.VolumeNotification},
+		{v1.SourceNotification},
+	}, [][]v1.NotificationTag{
+		{v1.PowerNotification},
+		{v1.SourceNotification, v1.VolumeNotification},
+	})
+}
+
+func TestSubscriberDropPolicy(t *testing.T) {
+	s := newTestServer(t)
+	f := newFakeDevice(t, net.IPv4(127, 0, 0, 2), map[v1.NotificationTag]string{
+		v1.VolumeNotification: "-30.0",
+	})
+	d, err := s.RegisterDevice(f.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := s.Subscribe(d.IP, SubscribeOptions{BufferSize: 1, Policy: DropPolicy}, v1.VolumeNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// subscribed after full, so it's delivered to after it
+	observer, err := s.Subscribe(d.IP, SubscribeOptions{BufferSize: 8}, v1.VolumeNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, observer.C)
+
+	f.notify(t, v1.Property{Tag: v1.VolumeNotification, Value: "-20.0", Visible: true})
+	if p := receive(t, observer.C); p.Value != "-20.0" {
+		t.Fatalf("observer got %+v, want volume -20.0", p)
+	}
+	// the current value filled the channel, so the change was dropped
+	if p := receive(t, full.C); p.Value != "-30.0" {
+		t.Errorf("got %+v, want the current value", p)
+	}
+	expectNothing(t, full.C)
+}
+
+func TestSubscriberBlockPolicy(t *testing.T) {
+	s := newTestServer(t)
+	f := newFakeDevice(t, net.IPv4(127, 0, 0, 2), nil)
+	d, err := s.RegisterDevice(f.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := s.Subscribe(d.IP, SubscribeOptions{Policy: BlockPolicy}, v1.VolumeNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, sub.C)
+
+	values := []string{"-29.0", "-28.0", "-27.0"}
+	for _, value := range values {
+		f.notify(t, v1.Property{Tag: v1.VolumeNotification, Value: value, Visible: true})
+	}
+	for _, value := range values {
+		if p := receive(t, sub.C); p.Value != value {
+			t.Errorf("got %+v, want volume %s", p, value)
+		}
+	}
+}
+
+func TestUnregisterClosesSubscribers(t *testing.T) {
+	s := newTestServer(t)
+	f := newFakeDevice(t, net.IPv4(127, 0, 0, 2), nil)
+	d, err := s.RegisterDevice(f.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := s.Subscribe(d.IP, SubscribeOptions{BufferSize: 8}, v1.PowerNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, sub.C)
+
+	err = s.UnregisterDevice(d.IP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-sub.C; ok {
+		t.Error("subscriber's channel wasn't closed")
+	}
+	// the device is gone, so closing the subscriber sends nothing
+	err = sub.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.waitForRequests(t, [][]v1.NotificationTag{{v1.PowerNotification}}, nil)
+}
+
+func TestServerDeliversBySourceIP(t *testing.T) {
+	s := newTestServer(t)
+	living := newFakeDevice(t, net.IPv4(127, 0, 0, 2), nil)
+	theater := newFakeDevice(t, net.IPv4(127, 0, 0, 3), nil)
+	unregistered := newFakeDevice(t, net.IPv4(127, 0, 0, 4), nil)
+	livingDevice, err := s.RegisterDevice(living.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+	theaterDevice, err := s.RegisterDevice(theater.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := notifyAddr(s)
+	unregistered.send(t, addr, v1.Notification{Sequence: 9})
+	living.send(t, addr, v1.Notification{Sequence: 1, Properties: []v1.Property{{Tag: v1.PowerNotification, Value: "On", Visible: true}}})
+	theater.send(t, addr, v1.ControlResponse{Acks: []v1.CommandAck{{Tag: v1.PowerOnCommand, Status: v1.StatusAck}}})
+
+	select {
+	case n := <-livingDevice.Notifications:
+		if n.Sequence != 1 {
+			t.Errorf("got notification %+v, want sequence 1 from living", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for living's notification")
+	}
+	select {
+	case resp := <-theaterDevice.Controls:
+		if len(resp.Acks) != 1 || resp.Acks[0].Tag != v1.PowerOnCommand {
+			t.Errorf("got control response %+v, want power_on ack from theater", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for theater's control response")
+	}
+
+	// packets are read in order, so anything misdelivered would be waiting by now
+	select {
+	case n := <-livingDevice.Notifications:
+		t.Errorf("living got unexpected notification %+v", n)
+	case resp := <-livingDevice.Controls:
+		t.Errorf("living got unexpected control response %+v", resp)
+	case n := <-theaterDevice.Notifications:
+		t.Errorf("theater got unexpected notification %+v", n)
+	default:
+	}
+}
+
+func TestServeClosesDevices(t *testing.T) {
+	s := NewServer(net.IPv4(127, 0, 0, 1))
+	s.ControlPort = 0
+	s.NotifyPort = 0
+	f := newFakeDevice(t, net.IPv4(127, 0, 0, 2), nil)
+	d, err := s.RegisterDevice(f.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Serve(ctx) }()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't return after its context was closed")
+	}
+	if _, ok := <-d.Notifications; ok {
+		t.Error("device's notifications weren't closed")
+	}
+	if _, ok := s.Device(d.IP); ok {
+		t.Error("device still registered after Serve returned")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+// StateChange is emitted by a StateTracker when a property changes
+type StateChange struct {
+	Property v1.Property
+	// State is a snapshot of the device's state after the change
+	State v1.DeviceState
+}
+
+// StateTracker maintains a device's DeviceState from the properties it reports
+type StateTracker struct {
+	mu    sync.RWMutex
+	state *v1.DeviceState
+
+	changes chan StateChange
+}
+
+// NewStateTracker makes a StateTracker for d. Changes are dropped if bufferSize of them are waiting
+// to be received
+func NewStateTracker(d v1.Device, bufferSize int) *StateTracker {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	return &StateTracker{
+		state:   v1.NewDeviceState(d),
+		changes: make(chan StateChange, bufferSize),
+	}
+}
+
+// TrackState subscribes to the StateTags of the device registered for ip, and runs a StateTracker
+// for it until ctx is closed or the device is unregistered
+func (s *Server) TrackState(ctx context.Context, ip net.IP, bufferSize int) (*StateTracker, error) {
+	d, ok := s.Device(ip)
+	if !ok {
+		return nil, errors.New("device not registered: " + ip.String())
+	}
+	sub, err := s.Subscribe(ip, SubscribeOptions{BufferSize: DefaultBufferSize}, v1.StateTags...)
+	if err != nil {
+		return nil, err
+	}
+	t := NewStateTracker(d.Device, bufferSize)
+	go func() {
+		t.Run(ctx, sub.C)
+		sub.Close()
+	}()
+	return t, nil
+}
+
+// Run applies properties received from props until it's closed or ctx is closed, then closes the
+// channel returned by Changes
+func (t *StateTracker) Run(ctx context.Context, props <-chan v1.Property) {
+	defer close(t.changes)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p, ok := <-props:
+			if !ok {
+				return
+			}
+			t.apply(p)
+		}
+	}
+}
+
+// apply updates the state with reported properties, emitting a StateChange for each which changed.
+// It's only called by Run, so changes are never sent after the channel is closed
+func (t *StateTracker) apply(props ...v1.Property) {
+	for _, p := range props {
+		t.mu.Lock()
+		changed := t.state.Apply(p)
+		var snapshot v1.DeviceState
+		if changed {
+			snapshot = t.state.Copy()
+		}
+		t.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		select {
+		case t.changes <- StateChange{Property: p, State: snapshot}:
+		default:
+			log.WithFields(log.Fields{
+				"device":   snapshot.Name,
+				"property": p.Tag.String(),
+			}).Warn("state change channel full, dropped change")
+		}
+	}
+}
+
+// Snapshot returns a copy of the current state
+func (t *StateTracker) Snapshot() v1.DeviceState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.state.Copy()
+}
+
+// Changes returns a channel receiving each change to the state. It's closed once Run returns
+func (t *StateTracker) Changes() <-chan StateChange {
+	return t.changes
+}
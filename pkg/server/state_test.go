@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStateTrackerApply(t *testing.T) {
+	tracker := NewStateTracker(v1.Device{Name: "living"}, 8)
+	tracker.apply(
+		v1.Property{Tag: v1.PowerNotification, Value: "On", Visible: true},
+		v1.Property{Tag: v1.PowerNotification, Value: "On", Visible: true},
+		v1.Property{Tag: v1.VolumeNotification, Value: "-30.0", Visible: true},
+	)
+
+	// the repeated power property isn't a change
+	want := []v1.NotificationTag{v1.PowerNotification, v1.VolumeNotification}
+	for _, tag := range want {
+		select {
+		case change := <-tracker.Changes():
+			if change.Property.Tag != tag {
+				t.Errorf("got change to %s, want %s", change.Property.Tag, tag)
+			}
+			if !change.State.Power {
+				t.Errorf("got state %+v, want power on", change.State)
+			}
+		default:
+			t.Fatalf("no change to %s", tag)
+		}
+	}
+	select {
+	case change := <-tracker.Changes():
+		t.Errorf("got unexpected change %+v", change)
+	default:
+	}
+
+	state := tracker.Snapshot()
+	if !state.Power || state.VolumeDB != -30 {
+		t.Errorf("got state %+v, want power on at -30", state)
+	}
+}
+
+func TestStateTrackerDropsWhenFull(t *testing.T) {
+	tracker := NewStateTracker(v1.Device{Name: "living"}, 1)
+	tracker.apply(
+		v1.Property{Tag: v1.PowerNotification, Value: "On"},
+		v1.Property{Tag: v1.VolumeNotification, Value: "-30.0"},
+	)
+	change := <-tracker.Changes()
+	if change.Property.Tag != v1.PowerNotification {
+		t.Errorf("got change to %s, want power", change.Property.Tag)
+	}
+	// the dropped change is still applied to the state
+	if state := tracker.Snapshot(); state.VolumeDB != -30 {
+		t.Errorf("got volume %v, want -30", state.VolumeDB)
+	}
+}
+
+func TestStateTrackerRun(t *testing.T) {
+	tracker := NewStateTracker(v1.Device{Name: "living"}, 8)
+	props := make(chan v1.Property, 1)
+	done := make(chan struct{})
+	go func() {
+		tracker.Run(context.Background(), props)
+		close(done)
+	}()
+
+	props <- v1.Property{Tag: v1.PowerNotification, Value: "On"}
+	select {
+	case change := <-tracker.Changes():
+		if !change.State.Power {
+			t.Errorf("got state %+v, want power on", change.State)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a change")
+	}
+
+	close(props)
+	<-done
+	if _, ok := <-tracker.Changes(); ok {
+		t.Error("changes weren't closed after Run returned")
+	}
+}
+
+func TestTrackState(t *testing.T) {
+	s := newTestServer(t)
+	f := newFakeDevice(t, net.IPv4(127, 0, 0, 2), map[v1.NotificationTag]string{
+		v1.PowerNotification: "On",
+	})
+	d, err := s.RegisterDevice(f.Device())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker, err := s.TrackState(ctx, d.IP, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscribe reply reports every state tag, wait for the power one
+	for {
+		select {
+		case change := <-tracker.Changes():
+			if change.Property.Tag != v1.PowerNotification {
+				continue
+			}
+			if !change.State.Power {
+				t.Errorf("got state %+v, want power on", change.State)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the power state")
+		}
+		break
+	}
+
+	// the tracker unsubscribes once its context is closed
+	cancel()
+	f.waitForRequests(t, [][]v1.NotificationTag{sortedStateTags()}, [][]v1.NotificationTag{sortedStateTags()})
+}
+
+func sortedStateTags() []v1.NotificationTag {
+	tags := append([]v1.NotificationTag(nil), v1.StateTags...)
+	sortTags(tags)
+	return tags
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"errors"
+	"git.poundadm.net/anachronism/xmcctl/pkg/apis/protocol/v1"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+)
+
+// DeliveryPolicy controls what happens to property changes when a Subscriber's channel is full
+type DeliveryPolicy int
+
+const (
+	// DropPolicy discards changes which don't fit in the Subscriber's channel
+	DropPolicy DeliveryPolicy = iota
+	// BlockPolicy waits for the Subscriber to receive each change. Delivery to every other consumer of
+	// the Server is stalled while waiting
+	BlockPolicy
+)
+
+// SubscribeOptions configures a Subscriber
+type SubscribeOptions struct {
+	// BufferSize is the capacity of the Subscriber's channel
+	BufferSize int
+	// Policy controls what happens when the Subscriber's channel is full
+	Policy DeliveryPolicy
+}
+
+// Subscriber receives changes to a set of properties of a single registered device. The device is
+// only asked to stop sending notifications for a property once every subscriber to it is closed.
+type Subscriber struct {
+	// C receives the current value of each subscribed property, followed by each change. It's closed
+	// when the Subscriber is closed or the device is unregistered
+	C <-chan v1.Property
+	// Policy controls what happens when C is full
+	Policy DeliveryPolicy
+
+	server *Server
+	device *RegisteredDevice
+	tags   map[v1.NotificationTag]bool
+
+	c    chan v1.Property
+	done chan struct{}
+	once sync.Once
+	// mu guards closed and sends to c
+	mu     sync.Mutex
+	closed bool
+}
+
+// Subscribe starts delivering changes to tags of the device registered for ip to a new Subscriber.
+// The device is only sent a subscribe request for tags which have no other subscribers, the current
+// value of the others is delivered immediately if it's known
+func (s *Server) Subscribe(ip net.IP, opts SubscribeOptions, tags ...v1.NotificationTag) (*Subscriber, error) {
+	d, ok := s.Device(ip)
+	if !ok {
+		return nil, errors.New("device not registered: " + ip.String())
+	}
+
+	bufferSize := opts.BufferSize
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	c := make(chan v1.Property, bufferSize)
+	sub := &Subscriber{
+		C:      c,
+		Policy: opts.Policy,
+		server: s,
+		device: d,
+		tags:   make(map[v1.NotificationTag]bool, len(tags)),
+		c:      c,
+		done:   make(chan struct{}),
+	}
+	for _, tag := range tags {
+		sub.tags[tag] = true
+	}
+
+	newTags := make([]v1.NotificationTag, 0)
+	current := make([]v1.Property, 0)
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, errors.New("device not registered: " + ip.String())
+	}
+	for tag := range sub.tags {
+		if d.refs[tag] == 0 {
+			newTags = append(newTags, tag)
+		} else if prop, ok := d.subscriptions[tag]; ok {
+			current = append(current, prop)
+		}
+		d.refs[tag]++
+	}
+	d.subscribers = append(d.subscribers, sub)
+	d.mu.Unlock()
+
+	// nothing is receiving from the channel yet, so never block on the current values
+	for _, prop := range current {
+		sub.deliver(prop, false)
+	}
+
+	if len(newTags) > 0 {
+		sortTags(newTags)
+		err := s.Send(ip, v1.SubscribeRequest{Protocol: d.Protocol(), Tags: newTags})
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+// Tags returns the properties the Subscriber receives changes to
+func (sub *Subscriber) Tags() []v1.NotificationTag {
+	tags := make([]v1.NotificationTag, 0, len(sub.tags))
+	for tag := range sub.tags {
+		tags = append(tags, tag)
+	}
+	sortTags(tags)
+	return tags
+}
+
+// Close stops delivery to the Subscriber and closes its channel. The device is asked to stop sending
+// notifications for any tags which no longer have subscribers
+func (sub *Subscriber) Close() error {
+	sub.shutdown()
+
+	d := sub.device
+	stale := make([]v1.NotificationTag, 0)
+	d.mu.Lock()
+	found := false
+	for i, other := range d.subscribers {
+		if other == sub {
+			d.subscribers = append(d.subscribers[:i], d.subscribers[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found {
+		for tag := range sub.tags {
+			d.refs[tag]--
+			if d.refs[tag] <= 0 {
+				delete(d.refs, tag)
+				stale = append(stale, tag)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	if len(stale) == 0 {
+		return nil
+	}
+	// if the device was unregistered and registered again, the new registration owns its subscriptions
+	if current, ok := sub.server.Device(d.IP); !ok || current != d {
+		return nil
+	}
+	sortTags(stale)
+	return sub.server.Send(d.IP, v1.UnsubscribeRequest{Protocol: d.Protocol(), Tags: stale})
+}
+
+// Resubscribe sends the device registered for ip a subscribe request for every tag which has
+// subscribers. Devices forget their subscriptions when they restart, so this restores them, and the
+// current value of each tag is delivered to its subscribers again
+func (s *Server) Resubscribe(ip net.IP) error {
+	d, ok := s.Device(ip)
+	if !ok {
+		return errors.New("device not registered: " + ip.String())
+	}
+	d.mu.RLock()
+	tags := make([]v1.NotificationTag, 0, len(d.refs))
+	for tag := range d.refs {
+		tags = append(tags, tag)
+	}
+	d.mu.RUnlock()
+
+	if len(tags) == 0 {
+		return nil
+	}
+	sortTags(tags)
+	return s.Send(ip, v1.SubscribeRequest{Protocol: d.Protocol(), Tags: tags})
+}
+
+// deliver sends a change to the Subscriber, waiting for it to be received if block is set
+func (sub *Subscriber) deliver(prop v1.Property, block bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	if block {
+		select {
+		case sub.c <- prop:
+		case <-sub.done:
+		}
+		return
+	}
+	select {
+	case sub.c <- prop:
+	default:
+		log.WithFields(log.Fields{
+			"device":   sub.device.Name,
+			"property": prop.Tag.String(),
+		}).Warn("subscriber channel full, dropped property change")
+	}
+}
+
+// shutdown closes the Subscriber's channel, unblocking any pending delivery first
+func (sub *Subscriber) shutdown() {
+	sub.once.Do(func() {
+		close(sub.done)
+		sub.mu.Lock()
+		sub.closed = true
+		close(sub.c)
+		sub.mu.Unlock()
+	})
+}
+
+func sortTags(tags []v1.NotificationTag) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+}